@@ -8,7 +8,7 @@ import (
 )
 
 func NewBrowser(url string) Runnable {
-	return func(kill chan struct{}) (chan bool, chan struct{}) {
+	return func(kill chan struct{}, run *Run) (chan bool, chan struct{}) {
 		command := fmt.Sprintf("google-chrome \"%s\"", url)
 
 		cmd := &Cmd{
@@ -35,4 +35,6 @@ func (cmd *Cmd) RunBrowser() {
 	if err != nil {
 		log.Err("Error opening URL (error, output):", err, string(output))
 	}
+
+	cmd.done <- err == nil
 }
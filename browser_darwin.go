@@ -45,7 +45,7 @@ var chromeApplescript = `
 `
 
 func NewBrowser(url string) Runnable {
-	return func(kill chan struct{}) (chan bool, chan struct{}) {
+	return func(kill chan struct{}, run *Run) (chan bool, chan struct{}) {
 		cmd := &Cmd{
 			Cmd:  exec.Command("osascript"),
 			Name: url,
@@ -78,4 +78,6 @@ func (cmd *Cmd) RunBrowser(url string) {
 	if err != nil {
 		log.Fatal("AppleScript Error:", string(output))(3)
 	}
+
+	cmd.done <- true
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cgroupLimits are the resource limits of the cgroup of a step. Zero values are
+// unlimited.
+type cgroupLimits struct {
+	// memory is in bytes.
+	memory int64
+	// cpu is a number of CPUs, 1.5 is one and a half CPUs.
+	cpu  float64
+	pids int
+}
+
+// cgroupStats are the resources used by the processes of a cgroup.
+type cgroupStats struct {
+	cpu time.Duration
+	// peak memory in bytes, 0 if the kernel does not report it.
+	peak int64
+	// oomKills counts processes killed for exceeding the memory limit.
+	oomKills int
+}
+
+// parseMemory parses a number of bytes with an optional K, M, G or T suffix,
+// powers of 1024 like the kernel uses for memory.max.
+func parseMemory(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	shift := uint(0)
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		shift = 10 * uint(strings.IndexByte("KMGT", s[i])+1)
+		s = s[:i]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q, use bytes or a K, M, G or T suffix", s)
+	}
+	return n << shift, nil
+}
+
+// formatBytes formats n bytes for humans, like 1.5GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// cgroupLimits returns the limits of the cgroup of the step. The limits have
+// been validated by chainSteps.
+func (step *Step) cgroupLimits() cgroupLimits {
+	limits := cgroupLimits{cpu: step.CPUMax, pids: step.PidsMax}
+	if step.MemoryMax != "" {
+		limits.memory, _ = parseMemory(step.MemoryMax)
+	}
+	return limits
+}
+
+// reportCgroup logs the resources used by the processes of the step and if any
+// were killed for exceeding its memory limit.
+func (cmd *Cmd) reportCgroup() {
+	stats, err := cmd.cgroup.stats()
+	if err != nil {
+		cmd.log.Debug("Error reading cgroup stats (step, error):", cmd.Name, err)
+		return
+	}
+
+	if stats.oomKills > 0 {
+		cmd.log.Err("Step ran out of memory, processes killed (step, memory_max, killed):",
+			cmd.Name, formatBytes(cmd.cgroup.limits.memory), stats.oomKills)
+	}
+
+	if stats.peak > 0 {
+		cmd.log.Info("Step resources (step, peak memory, cpu time):", cmd.Name, formatBytes(stats.peak), stats.cpu)
+	} else {
+		cmd.log.Info("Step resources (step, cpu time):", cmd.Name, stats.cpu)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cgroupControllers are enabled for the cgroups of steps, if available.
+var cgroupControllers = []string{"memory", "cpu", "pids"}
+
+// cgroupCount makes the names of cgroups unique, along with the pid of Wago.
+var cgroupCount uint64
+
+// cgroup is the cgroup v2 a command is run in. All processes of the command,
+// whatever their process group or session, stay in it and can be killed
+// together.
+type cgroup struct {
+	path   string
+	limits cgroupLimits
+
+	// dir is open while the command starts, it is started in the cgroup with
+	// clone3.
+	dir *os.File
+}
+
+// setupCgroup resolves -cgroup to the dir below which the cgroups of steps are
+// created and enables the controllers of the limits in it.
+//
+// "self" is the cgroup Wago is started in, like a systemd scope with
+// Delegate=yes. Wago moves itself into a wago cgroup below it, as the controllers
+// of a cgroup can only be enabled for its children if it has no processes.
+func setupCgroup(cfg *Config) error {
+	if cfg.Cgroup == "" {
+		return nil
+	}
+
+	mount, err := cgroupMount()
+	if err != nil {
+		return err
+	}
+
+	dir := cfg.Cgroup
+	if dir == "self" {
+		data, err := ioutil.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return err
+		}
+		// The cgroup v2 line is 0::/path.
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "0::") {
+				dir = filepath.Join(mount, strings.TrimPrefix(line, "0::"))
+			}
+		}
+		if dir == "self" {
+			return fmt.Errorf("cgroup v2 of Wago not found in /proc/self/cgroup")
+		}
+
+		leaf := filepath.Join(dir, "wago")
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		pid := strconv.Itoa(os.Getpid())
+		if err := ioutil.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644); err != nil {
+			return fmt.Errorf("moving Wago to %s: %v", leaf, err)
+		}
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(mount, dir)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 dir: %v", dir, err)
+	}
+	available := strings.Fields(string(data))
+
+	var missing []string
+	for _, controller := range cgroupControllers {
+		if !contains(available, controller) {
+			missing = append(missing, controller)
+			continue
+		}
+		err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644)
+		if err != nil {
+			return fmt.Errorf("enabling %s controller in %s: %v", controller, dir, err)
+		}
+	}
+	if len(missing) > 0 {
+		log.Warn("Cgroup controllers not available, their limits can't be set (cgroup, controllers):",
+			dir, strings.Join(missing, ","))
+	}
+
+	log.Debug("Running commands in cgroups below:", dir)
+	cfg.cgroup = dir
+	return nil
+}
+
+// cgroupMount returns where the cgroup v2 hierarchy is mounted, /sys/fs/cgroup
+// on most systems or /sys/fs/cgroup/unified in hybrid mode.
+func cgroupMount() (string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 2 && fields[2] == "cgroup2" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("cgroup v2 is not mounted")
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// newCgroup creates a cgroup for a command of the step name below parent and
+// sets its limits.
+func newCgroup(parent, name string, limits cgroupLimits) (*cgroup, error) {
+	name = strings.Replace(name, string(filepath.Separator), "_", -1)
+	path := filepath.Join(parent, fmt.Sprintf("%s.%d.%d", name, os.Getpid(), atomic.AddUint64(&cgroupCount, 1)))
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, err
+	}
+	cg := &cgroup{path: path, limits: limits}
+
+	files := make(map[string]string)
+	if limits.memory > 0 {
+		files["memory.max"] = strconv.FormatInt(limits.memory, 10)
+		// An out of memory step is killed as a whole, not one of its processes.
+		files["memory.oom.group"] = "1"
+	}
+	if limits.cpu > 0 {
+		const period = 100000
+		files["cpu.max"] = fmt.Sprintf("%d %d", int64(limits.cpu*period), period)
+	}
+	if limits.pids > 0 {
+		files["pids.max"] = strconv.Itoa(limits.pids)
+	}
+	for file, value := range files {
+		if err := cg.write(file, value); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+
+	var err error
+	cg.dir, err = os.Open(path)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+// write writes value to a file of the cgroup.
+func (cg *cgroup) write(file, value string) error {
+	return ioutil.WriteFile(filepath.Join(cg.path, file), []byte(value), 0644)
+}
+
+// read returns the keys and values of a flat keyed file of the cgroup, like
+// cpu.stat.
+func (cg *cgroup) read(file string) (map[string]int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(cg.path, file))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]int64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			values[fields[0]], _ = strconv.ParseInt(fields[1], 10, 64)
+		} else if len(fields) == 1 {
+			// Single value files like memory.peak.
+			values[""], _ = strconv.ParseInt(fields[0], 10, 64)
+		}
+	}
+	return values, nil
+}
+
+// attach sets attr to start a process in the cgroup.
+func (cg *cgroup) attach(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cg.dir.Fd())
+}
+
+// started closes the dir of the cgroup once the process has started.
+func (cg *cgroup) started() {
+	cg.dir.Close()
+}
+
+// populated reports whether any process is still in the cgroup.
+func (cg *cgroup) populated() bool {
+	events, err := cg.read("cgroup.events")
+	return err == nil && events["populated"] != 0
+}
+
+// kill sends SIGKILL to every process in the cgroup and waits up to
+// descendantWait for them to exit.
+func (cg *cgroup) kill() {
+	// cgroup.kill is available since Linux 5.14.
+	if err := cg.write("cgroup.kill", "1"); err != nil {
+		data, _ := ioutil.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+		for _, field := range strings.Fields(string(data)) {
+			if pid, err := strconv.Atoi(field); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(descendantWait)
+	for cg.populated() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stats returns the resources used by the processes of the cgroup.
+func (cg *cgroup) stats() (cgroupStats, error) {
+	var stats cgroupStats
+
+	cpu, err := cg.read("cpu.stat")
+	if err != nil {
+		return stats, err
+	}
+	stats.cpu = time.Duration(cpu["usage_usec"]) * time.Microsecond
+
+	// Without the memory controller, or before Linux 5.19, there is no peak.
+	if peak, err := cg.read("memory.peak"); err == nil {
+		stats.peak = peak[""]
+	}
+	if events, err := cg.read("memory.events"); err == nil {
+		stats.oomKills = int(events["oom_kill"])
+	}
+
+	return stats, nil
+}
+
+// remove removes the cgroup, which must be empty.
+func (cg *cgroup) remove() {
+	if err := syscall.Rmdir(cg.path); err != nil {
+		log.Debug("Error removing cgroup (path, error):", cg.path, err)
+	}
+}
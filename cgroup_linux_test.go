@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCgroup(t *testing.T) {
+	mount, err := cgroupMount()
+	if err != nil {
+		t.Skip("Skipping cgroup test:", err)
+	}
+	parent, err := ioutil.TempDir(mount, "wago")
+	if err != nil {
+		t.Skip("Skipping cgroup test, can't create cgroups:", err)
+	}
+	defer os.Remove(parent)
+
+	cfg := testConfig()
+	cfg.Cgroup = filepath.Base(parent)
+	assert.NoError(t, setupCgroup(cfg))
+	assert.Equal(t, parent, cfg.cgroup)
+
+	cg, err := newCgroup(cfg.cgroup, "server/api", cgroupLimits{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(filepath.Base(cg.path), "server_api."), cg.path)
+
+	// The second sleep leaves the process group, but not the cgroup.
+	cmd := exec.Command("/bin/sh", "-c", "sleep 10 & setsid sleep 10 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cg.attach(cmd.SysProcAttr)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	cg.started()
+
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), filepath.Base(cg.path))
+	data, err = ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", cmd.Process.Pid))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), filepath.Base(cg.path))
+
+	assert.True(t, cg.populated())
+	cg.kill()
+	cmd.Wait()
+	assert.False(t, cg.populated())
+
+	_, err = cg.stats()
+	assert.NoError(t, err)
+
+	cg.remove()
+	_, err = os.Stat(cg.path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// cgroup is not available, cgroups are only supported on Linux.
+type cgroup struct {
+	limits cgroupLimits
+}
+
+// setupCgroup returns an error if -cgroup is set.
+func setupCgroup(cfg *Config) error {
+	if cfg.Cgroup != "" {
+		return fmt.Errorf("cgroups are only supported on Linux")
+	}
+	return nil
+}
+
+func newCgroup(parent, name string, limits cgroupLimits) (*cgroup, error) {
+	return nil, fmt.Errorf("cgroups are only supported on Linux")
+}
+
+func (cg *cgroup) attach(attr *syscall.SysProcAttr) {}
+
+func (cg *cgroup) started() {}
+
+func (cg *cgroup) populated() bool { return false }
+
+func (cg *cgroup) kill() {}
+
+func (cg *cgroup) stats() (cgroupStats, error) {
+	return cgroupStats{}, fmt.Errorf("cgroups are only supported on Linux")
+}
+
+func (cg *cgroup) remove() {}
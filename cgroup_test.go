@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		s string
+		n int64
+	}{
+		{"1024", 1024},
+		{"512K", 512 << 10},
+		{"4G", 4 << 30},
+		{"1t", 1 << 40},
+	}
+	for _, test := range tests {
+		n, err := parseMemory(test.s)
+		assert.NoError(t, err, test.s)
+		assert.Equal(t, test.n, n, test.s)
+	}
+
+	for _, s := range []string{"", "G", "1.5G", "-1", "4GB", "max"} {
+		_, err := parseMemory(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512B", formatBytes(512))
+	assert.Equal(t, "1.5KiB", formatBytes(1536))
+	assert.Equal(t, "4.0GiB", formatBytes(4<<30))
+	assert.Equal(t, "2048.0TiB", formatBytes(2<<50))
+}
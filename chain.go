@@ -0,0 +1,336 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// chain runs the action chain as a dependency graph. Each step is started once
+// all of the steps it depends on have signalled a successful done, so independent
+// steps run concurrently. When a step fails, only the steps downstream of it are
+// abandoned.
+//
+// Steps are killed and restarted individually. Restarting a step always restarts
+// every step downstream of it, steps upstream are left running.
+//
+// chain is not safe for concurrent use, it is driven by the main event loop.
+type chain struct {
+	log prefixLog
+
+	steps     []*Step
+	runnables []Runnable
+	scopes    []*scope
+
+	deps       [][]int
+	dependents [][]int
+
+	// State of the current run of each step, replaced each time it is started.
+	//
+	// kill is closed to kill the step, it is set to nil once closed.
+	kill []chan struct{}
+	// finished is closed once the step has signalled done, has been abandoned or
+	// has been killed.
+	finished []chan struct{}
+	// ok is the success of the step, written by the step's goroutine before
+	// finished is closed. It must only be read after receiving from finished.
+	ok []bool
+	// stopped is closed once finished is closed and the process is dead.
+	stopped []chan struct{}
+	// exited is set for a daemon that exited on its own and is not restarted,
+	// even after it was done. It must only be read after receiving from stopped.
+	exited []bool
+}
+
+// newChain constructs a chain from steps. Nothing is started.
+func newChain(cfg *Config, steps []*Step) (*chain, error) {
+	deps, err := stepDeps(steps)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &chain{
+		log:        prefixLog(cfg.Name),
+		steps:      steps,
+		runnables:  make([]Runnable, len(steps)),
+		scopes:     make([]*scope, len(steps)),
+		deps:       deps,
+		dependents: make([][]int, len(steps)),
+		kill:       make([]chan struct{}, len(steps)),
+		finished:   make([]chan struct{}, len(steps)),
+		ok:         make([]bool, len(steps)),
+		stopped:    make([]chan struct{}, len(steps)),
+		exited:     make([]bool, len(steps)),
+	}
+
+	for i, step := range steps {
+		// Construct a Runnable (user specified action) for each step.
+		c.runnables[i] = step.Runnable(cfg)
+
+		c.scopes[i], err = newScope(step.Watch, step.WatchRegex)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range deps[i] {
+			c.dependents[d] = append(c.dependents[d], i)
+		}
+	}
+
+	return c, nil
+}
+
+// all returns a set containing every step.
+func (c *chain) all() []bool {
+	set := make([]bool, len(c.steps))
+	for i := range set {
+		set[i] = true
+	}
+	return set
+}
+
+// names returns the step names of set for logging.
+func (c *chain) names(set []bool) string {
+	names := make([]string, 0, len(set))
+	for i, in := range set {
+		if in {
+			names = append(names, c.steps[i].Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// affected returns the set of steps watching the relative path name.
+func (c *chain) affected(name string) []bool {
+	set := make([]bool, len(c.steps))
+	for i, s := range c.scopes {
+		set[i] = s.match(name)
+	}
+	return set
+}
+
+// failed reports whether step i has finished without success or is a daemon
+// that has exited since. Steps that are still starting have not failed.
+func (c *chain) failed(i int) bool {
+	if c.finished[i] == nil {
+		return false
+	}
+
+	select {
+	case <-c.finished[i]:
+		if !c.ok[i] {
+			return true
+		}
+	default:
+		return false
+	}
+
+	select {
+	case <-c.stopped[i]:
+		return c.exited[i]
+	default:
+		return false
+	}
+}
+
+// restartSet expands the affected set of steps to those that need restarting:
+// failed steps upstream of a restarted step, so that they are retried, and
+// every step downstream.
+func (c *chain) restartSet(affected []bool) []bool {
+	set := make([]bool, len(c.steps))
+
+	var upstream func(i int)
+	upstream = func(i int) {
+		for _, d := range c.deps[i] {
+			if c.failed(d) {
+				set[d] = true
+			}
+			upstream(d)
+		}
+	}
+
+	var downstream func(i int)
+	downstream = func(i int) {
+		set[i] = true
+		for _, d := range c.dependents[i] {
+			downstream(d)
+		}
+	}
+
+	size := func() int {
+		n := 0
+		for _, in := range set {
+			if in {
+				n++
+			}
+		}
+		return n
+	}
+
+	copy(set, affected)
+
+	// Steps downstream may have failed steps upstream of them in turn.
+	for {
+		n := size()
+		for i, in := range set {
+			if in {
+				upstream(i)
+			}
+		}
+		for i, in := range set {
+			if in {
+				downstream(i)
+			}
+		}
+		if size() == n {
+			return set
+		}
+	}
+}
+
+// stop kills the steps in set and waits until all of their processes are dead.
+func (c *chain) stop(set []bool) {
+	for i, in := range set {
+		if in && c.kill[i] != nil {
+			close(c.kill[i])
+			c.kill[i] = nil
+		}
+	}
+
+	// Ensure all runnables (procs) are dead before they can be restarted.
+	for i, in := range set {
+		if in && c.stopped[i] != nil {
+			<-c.stopped[i]
+		}
+	}
+}
+
+// start starts the steps in set for run. Each waits for its dependencies before
+// running. Dependencies must either be in set or already be started.
+func (c *chain) start(set []bool, run *Run) {
+	for i, in := range set {
+		if in {
+			c.kill[i] = make(chan struct{})
+			c.finished[i] = make(chan struct{})
+			c.stopped[i] = make(chan struct{})
+			c.ok[i] = false
+			c.exited[i] = false
+		}
+	}
+
+	for i, in := range set {
+		if !in {
+			continue
+		}
+
+		// Capture the channels of this run, the fields are replaced by later runs.
+		deps := make([]chan struct{}, len(c.deps[i]))
+		for j, d := range c.deps[i] {
+			deps[j] = c.finished[d]
+		}
+
+		run.acquire()
+		go c.run(i, run, deps, c.kill[i], c.finished[i], c.stopped[i])
+	}
+}
+
+// run waits for the dependencies of step i and then runs it.
+func (c *chain) run(i int, run *Run, deps []chan struct{}, kill, finished, stopped chan struct{}) {
+	defer close(stopped)
+	defer run.release()
+
+	// Wait for all dependencies to be done.
+	for j, dep := range deps {
+		select {
+		case <-dep:
+		case <-kill:
+			close(finished)
+			return
+		}
+
+		if d := c.deps[i][j]; !c.ok[d] {
+			c.log.Info("Step not started, dependency failed (step, dependency):",
+				c.steps[i].Name, c.steps[d].Name)
+			close(finished)
+			return
+		}
+	}
+
+	step := c.steps[i]
+	b := newBackoff(step.MaxRestarts, step.Backoff)
+
+	// finish signals the step done once, dependent steps are started if ok.
+	isFinished := false
+	finish := func(ok bool) {
+		if isFinished {
+			return
+		}
+		isFinished = true
+		c.ok[i] = ok
+		close(finished)
+	}
+
+	for {
+		// Start the Runnable, which starts and manages a user defined process.
+		started := time.Now()
+		done, dead := c.runnables[i](kill, run)
+
+		// Wait for either a kill or for the Runnable to signal done. If done is
+		// successful, dependent steps are started. A daemon that fails before it is
+		// done may be restarted first.
+		failed := false
+		select {
+		case ok := <-done:
+			failed = !ok
+			if ok {
+				finish(true)
+			} else if !isFinished && !step.Restart.restarts(true) {
+				c.log.Err("Step failed:", step.Name)
+				finish(false)
+			}
+		case <-kill:
+			finish(false)
+		}
+
+		// Wait for the Runnable (process) to exit completely.
+		<-dead
+
+		select {
+		case <-kill:
+			finish(false)
+			return
+		default:
+		}
+
+		// A daemon that was done sends its exit status once it has exited. Without
+		// one, it exited cleanly before it was done.
+		if !failed {
+			ok, sent := <-done
+			failed = sent && !ok
+		}
+
+		if !step.daemon() || !step.Restart.restarts(failed) {
+			c.exited[i] = step.daemon()
+			return
+		}
+
+		delay, ok := b.next(time.Since(started))
+		if !ok {
+			c.log.Err("Daemon keeps exiting, not restarting until the next change (step, restarts):",
+				step.Name, b.count)
+			if !isFinished {
+				c.log.Err("Step failed:", step.Name)
+				finish(false)
+			}
+			c.exited[i] = true
+			return
+		}
+
+		c.log.Warn("Restarting daemon (step, delay, restart):", step.Name, delay, b.count)
+		select {
+		case <-time.After(delay):
+		case <-kill:
+			finish(false)
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestartSet(t *testing.T) {
+	steps := []*Step{
+		{Name: "css", Kind: KindRunWait, Command: "true", Watch: []string{"*.css"}},
+		{Name: "build", Kind: KindRunWait, Command: "true", Watch: []string{"*.go"}},
+		{Name: "server", Kind: KindDaemonTimer, Command: "true", DependsOn: []string{"build"},
+			Watch: []string{"config/**"}},
+		{Name: "test", Kind: KindRunWait, Command: "true", DependsOn: []string{"css", "server"},
+			Watch: []string{"*_test.go"}},
+	}
+
+	c, err := newChain(testConfig(), steps)
+	assert.NoError(t, err)
+
+	// Nothing has run, so nothing has failed.
+	assert.Equal(t, "css, test", c.names(c.restartSet(c.affected("web/main.css"))))
+	assert.Equal(t, "build, server, test", c.names(c.restartSet(c.affected("main.go"))))
+	assert.Equal(t, "server, test", c.names(c.restartSet(c.affected("config/app.yaml"))))
+	assert.Equal(t, "build, server, test", c.names(c.restartSet(c.affected("main_test.go"))))
+	assert.Equal(t, "", c.names(c.restartSet(c.affected("readme.md"))))
+
+	// A failed upstream step is retried.
+	for i := range steps {
+		c.finished[i] = make(chan struct{})
+		close(c.finished[i])
+		c.ok[i] = true
+	}
+	c.ok[1] = false
+	assert.Equal(t, "build, server, test", c.names(c.restartSet(c.affected("config/app.yaml"))))
+
+	// So is a daemon that was done and has exited since.
+	c.ok[1] = true
+	for i := range steps {
+		c.stopped[i] = make(chan struct{})
+		close(c.stopped[i])
+	}
+	assert.Equal(t, "css, test", c.names(c.restartSet(c.affected("web/main.css"))))
+	c.exited[2] = true
+	assert.Equal(t, "css, server, test", c.names(c.restartSet(c.affected("web/main.css"))))
+	assert.Equal(t, "exited", c.state(2))
+}
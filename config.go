@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configFiles are the file names searched for, in order, when -config is not set.
+var configFiles = []string{"wago.yaml", "wago.yml"}
+
+// Config holds everything a user can configure. It is populated from an optional
+// config file and then from command line flags, flags taking precedence.
+//
+// YAML keys mirror flag names so that a config file reads the same as the
+// command line it replaces.
+type Config struct {
+	ConfigFile string `yaml:"-"`
+
+	// Name of the project, prefixes log messages.
+	Name string `yaml:"name"`
+
+	Verbose bool `yaml:"verbose"`
+	Quiet   bool `yaml:"quiet"`
+
+	BuildCmd      string `yaml:"cmd"`
+	DaemonCmd     string `yaml:"daemon"`
+	DaemonTimer   int    `yaml:"timer"`
+	DaemonTrigger string `yaml:"trigger"`
+	PostCmd       string `yaml:"pcmd"`
+	URL           string `yaml:"url"`
+
+	Timeout      time.Duration `yaml:"timeout"`
+	StartTimeout time.Duration `yaml:"starttimeout"`
+	FailTrigger  string        `yaml:"fail-trigger"`
+	DaemonReady  string        `yaml:"ready"`
+	ReadyTimeout time.Duration `yaml:"readytimeout"`
+
+	// Steps is an action chain of any length. It can only be set in the config
+	// file and replaces the chain built from -cmd, -daemon, -pcmd and -url.
+	Steps []*Step `yaml:"steps"`
+
+	// Projects are watched and run independently of each other. They can only be
+	// set in the config file and replace -dir and the action chain.
+	Projects []*Project `yaml:"projects"`
+
+	// Restart and MaxRestarts are the defaults of daemons, see Step.
+	Restart     string `yaml:"restart"`
+	MaxRestarts int    `yaml:"maxrestarts"`
+
+	ExitWait   int    `yaml:"exitwait"`
+	StopSignal string `yaml:"stopsignal"`
+	Shell      string `yaml:"shell"`
+	PTY        bool   `yaml:"pty"`
+	Prefix     bool   `yaml:"prefix"`
+	Hotkeys    bool   `yaml:"hotkeys"`
+	Control    string `yaml:"control"`
+
+	// Cgroup is a cgroup v2 dir, each command runs in a cgroup of its own below
+	// it. The limits are the defaults of steps, see Step.
+	Cgroup    string  `yaml:"cgroup"`
+	MemoryMax string  `yaml:"memorymax"`
+	CPUMax    float64 `yaml:"cpumax"`
+	PidsMax   int     `yaml:"pidsmax"`
+	// cgroup is the dir Cgroup resolves to once it is set up.
+	cgroup string
+
+	TargetDir   string `yaml:"dir"`
+	Recursive   bool   `yaml:"recursive"`
+	WatchRegex  string `yaml:"watch"`
+	IgnoreRegex string `yaml:"ignore"`
+	GitIgnore   bool   `yaml:"gitignore"`
+	// ig is the ignorer of the project, shared by the watcher and the main loop
+	// so both know the dirs seen by either, see ignorer.
+	ig *ignorer
+
+	// Include, Exclude and Ops replace WatchRegex when any are set.
+	Include globList `yaml:"include"`
+	Exclude globList `yaml:"exclude"`
+	Ops     string   `yaml:"ops"`
+
+	// GoDeps are Go packages, only the source files they depend on are watched.
+	GoDeps string `yaml:"go-deps"`
+	// deps is loaded from GoDeps once the projects are known.
+	deps *goDeps
+
+	Hash    bool  `yaml:"hash"`
+	HashMax int64 `yaml:"hashmax"`
+
+	Poll     time.Duration `yaml:"poll"`
+	PollHash bool          `yaml:"pollhash"`
+
+	Debounce    time.Duration `yaml:"debounce"`
+	DebounceMax time.Duration `yaml:"debouncemax"`
+
+	Fiddle    bool   `yaml:"fiddle"`
+	HTTPPort  string `yaml:"http"`
+	HTTP2Port string `yaml:"h2"`
+	KeyFile   string `yaml:"key"`
+	CertFile  string `yaml:"cert"`
+	WebRoot   string `yaml:"webroot"`
+}
+
+// bindFlags defines flags on fs which set the fields of cfg. Flag defaults are
+// the defaults of Wago.
+func bindFlags(cfg *Config, fs *flag.FlagSet) {
+	fs.StringVar(&cfg.ConfigFile, "config", "", "Config file, defaults to wago.yaml or wago.yml in -dir if present.")
+
+	fs.BoolVar(&cfg.Verbose, "v", false, "Verbose")
+	fs.BoolVar(&cfg.Quiet, "q", false, "Quiet, only warnings and errors")
+
+	fs.StringVar(&cfg.BuildCmd, "cmd", "", "Run command, wait for it to complete.")
+	fs.StringVar(&cfg.DaemonCmd, "daemon", "", "Run command and leave running in the background.")
+	fs.IntVar(&cfg.DaemonTimer, "timer", 0, "Wait milliseconds after starting daemon, then continue.")
+	fs.StringVar(&cfg.DaemonTrigger, "trigger", "", "Wait for a line of daemon output to match this regex, then continue.")
+	fs.StringVar(&cfg.FailTrigger, "fail-trigger", "", "Abort the chain if a line of daemon output matches this regex before -trigger, e.g. 'FATAL|address already in use'")
+	fs.DurationVar(&cfg.Timeout, "timeout", 0, "Kill and fail -cmd or -pcmd if it has not exited within this long, e.g. 5m")
+	fs.DurationVar(&cfg.StartTimeout, "starttimeout", 0, "Kill and fail the daemon if it has not output -trigger within this long, e.g. 30s")
+	fs.StringVar(&cfg.DaemonReady, "ready", "", "Wait until this probe of the daemon succeeds, then continue, e.g. tcp://localhost:8080, http://localhost:8080/health or file:///tmp/app.sock")
+	fs.DurationVar(&cfg.ReadyTimeout, "readytimeout", 30*time.Second, "Fail if the daemon is not ready within this long, used with -ready. 0 waits forever.")
+	fs.StringVar(&cfg.PostCmd, "pcmd", "", "Run command after daemon starts. Use this to kick off your test suite.")
+	fs.StringVar(&cfg.URL, "url", "", "Open browser to this URL after all commands are successful.")
+
+	fs.StringVar(&cfg.Restart, "restart", string(RestartNever), "Restart a daemon that exits on its own: never, on-failure or always.")
+	fs.IntVar(&cfg.MaxRestarts, "maxrestarts", 5, "Give up restarting a crashing daemon after this many consecutive restarts, -1 is unlimited.")
+	fs.IntVar(&cfg.ExitWait, "exitwait", 50, "Max milliseconds a process has after -stopsignal to exit before a SIGKILL.")
+	fs.StringVar(&cfg.StopSignal, "stopsignal", "TERM", "Signal sent to stop commands, e.g. INT or QUIT. SIGKILL follows after -exitwait.")
+	fs.StringVar(&cfg.Cgroup, "cgroup", "", "Run each command in a cgroup v2 of its own below this dir (Linux), relative to the cgroup mount, or self for the cgroup of Wago.")
+	fs.StringVar(&cfg.MemoryMax, "memorymax", "", "Memory limit of each command, used with -cgroup, e.g. 4G")
+	fs.Float64Var(&cfg.CPUMax, "cpumax", 0, "CPU limit of each command in CPUs, used with -cgroup, e.g. 1.5")
+	fs.IntVar(&cfg.PidsMax, "pidsmax", 0, "Process limit of each command, used with -cgroup.")
+	fs.StringVar(&cfg.Shell, "shell", "", "Shell to interpret commands, defaults to $SHELL, fallback to /bin/sh")
+	fs.BoolVar(&cfg.Prefix, "prefix", false, "Prefix each line of output with the name of its step, e.g. [daemon]")
+	fs.StringVar(&cfg.Control, "control", "", "Serve the control API on this address, POST /pause or /resume to pause or resume watching, e.g. localhost:8425")
+	fs.BoolVar(&cfg.Hotkeys, "hotkeys", false, "Handle :restart, :kill, :pause, :resume, :status, :verbose and :clear typed as a line instead of sending them to the step with focus.")
+	fs.BoolVar(&cfg.PTY, "pty", false, "Run commands attached to a pseudo-terminal, for colors and REPLs that need a terminal.")
+
+	fs.StringVar(&cfg.TargetDir, "dir", "", "Directory to watch, defaults to current.")
+	fs.BoolVar(&cfg.Recursive, "recursive", true, "Watch directory tree recursively.")
+	fs.StringVar(&cfg.WatchRegex, "watch", `/[^\.][^/]*": (CREATE|MODIFY$)`, "React to FS events matching regex. Use -v to see all events.")
+	fs.StringVar(&cfg.IgnoreRegex, "ignore", `\.(git|hg|svn)`, "Ignore directories matching regex.")
+	fs.Var(&cfg.Include, "include", "React to events for paths matching these comma separated globs, e.g. '**/*.go'. Replaces -watch.")
+	fs.Var(&cfg.Exclude, "exclude", "Ignore events for paths matching these comma separated globs, e.g. '**/*_gen.go'. Replaces -watch.")
+	fs.StringVar(&cfg.Ops, "ops", "", "React to these comma separated event types, defaults to create,write,remove,rename. Replaces -watch.")
+	fs.BoolVar(&cfg.GitIgnore, "gitignore", true, "Ignore paths excluded by .gitignore files. .wagoignore files are always used.")
+	fs.StringVar(&cfg.GoDeps, "go-deps", "", "Only watch the source files these Go packages depend on, found with go list, e.g. ./cmd/server")
+	fs.BoolVar(&cfg.Hash, "hash", true, "Ignore writes that don't change the contents of a file.")
+	fs.Int64Var(&cfg.HashMax, "hashmax", 10*1024*1024, "Largest file in bytes whose contents are compared by -hash, larger files always count as changed.")
+	fs.DurationVar(&cfg.Poll, "poll", 0, "Poll for changes at this interval instead of using file system events, e.g. 500ms")
+	fs.BoolVar(&cfg.PollHash, "pollhash", false, "When polling, also compare file contents to detect changes.")
+	fs.DurationVar(&cfg.Debounce, "debounce", 0, "Wait until there have been no events for this long before restarting, e.g. 150ms")
+	fs.DurationVar(&cfg.DebounceMax, "debouncemax", 2*time.Second, "Restart after this long even if events have not stopped, used with -debounce.")
+
+	fs.BoolVar(&cfg.Fiddle, "fiddle", false, "CLI fiddle mode! Start a web server, open browser to URL of targetDir/index.html")
+	fs.StringVar(&cfg.HTTPPort, "http", "", "Start a HTTP server on this port, e.g. :8420")
+	fs.StringVar(&cfg.HTTP2Port, "h2", "", "Start a HTTP/TLS server on this port, e.g. :8421")
+	fs.StringVar(&cfg.KeyFile, "key", "", "X.509 key file for HTTP2/TLS, eg: key.pem")
+	fs.StringVar(&cfg.CertFile, "cert", "", "X.509 cert file for HTTP2/TLS, eg: cert.pem")
+	fs.StringVar(&cfg.WebRoot, "webroot", "", "Local directory to use as root for web server, defaults to -dir.")
+}
+
+// defaultConfig returns a Config with all of the flag defaults set.
+func defaultConfig() *Config {
+	cfg := &Config{}
+	bindFlags(cfg, flag.NewFlagSet("defaults", flag.ContinueOnError))
+	return cfg
+}
+
+// findConfigFile returns the path of the config file to load, or an empty string
+// if there is none. An explicitly set -config must exist.
+func findConfigFile(cfg *Config) (string, error) {
+	if cfg.ConfigFile != "" {
+		if _, err := os.Stat(cfg.ConfigFile); err != nil {
+			return "", err
+		}
+		return cfg.ConfigFile, nil
+	}
+
+	dir := cfg.TargetDir
+	if dir == "" {
+		dir = "."
+	}
+
+	for _, name := range configFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	return "", nil
+}
+
+// loadConfigFile reads the YAML file at path into cfg. Only keys present in the
+// file are changed. Relative dirs in the file are relative to the file itself.
+func loadConfigFile(cfg *Config, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dir := cfg.TargetDir
+	cfg.TargetDir = ""
+
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	if cfg.TargetDir == "" {
+		cfg.TargetDir = dir
+	} else if !filepath.IsAbs(cfg.TargetDir) {
+		cfg.TargetDir = filepath.Join(filepath.Dir(path), cfg.TargetDir)
+	}
+
+	for _, project := range cfg.Projects {
+		if project.Dir != "" && !filepath.IsAbs(project.Dir) {
+			project.Dir = filepath.Join(filepath.Dir(path), project.Dir)
+		}
+	}
+
+	return nil
+}
+
+// parseConfig builds a Config from args parsed by fs and the config file, if
+// there is one. It returns the path of the config file, empty if there is none.
+// Flags set in args override values from the config file.
+func parseConfig(fs *flag.FlagSet, args []string) (*Config, string, error) {
+	cfg := &Config{}
+	bindFlags(cfg, fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, "", err
+	}
+
+	// Remember flags so they can be reapplied over the config file.
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	path, err := findConfigFile(cfg)
+	if err != nil || path == "" {
+		return cfg, "", err
+	}
+	if err := loadConfigFile(cfg, path); err != nil {
+		return nil, "", err
+	}
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return cfg, path, nil
+}
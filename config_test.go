@@ -0,0 +1,320 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "wago.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+dir: src
+cmd: go install
+daemon: app
+trigger: Listening
+exitwait: 200
+http: :8420
+debounce: 150ms
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg := defaultConfig()
+	assert.NoError(t, loadConfigFile(cfg, path))
+
+	assert.Equal(t, filepath.Join(filepath.Dir(path), "src"), cfg.TargetDir)
+	assert.Equal(t, "go install", cfg.BuildCmd)
+	assert.Equal(t, "app", cfg.DaemonCmd)
+	assert.Equal(t, "Listening", cfg.DaemonTrigger)
+	assert.Equal(t, 200, cfg.ExitWait)
+	assert.Equal(t, ":8420", cfg.HTTPPort)
+	assert.Equal(t, 150*time.Millisecond, cfg.Debounce)
+
+	// Keys not in the file keep their defaults.
+	assert.Equal(t, true, cfg.Recursive)
+	assert.Equal(t, defaultConfig().WatchRegex, cfg.WatchRegex)
+}
+
+func TestLoadConfigFileUnknownKey(t *testing.T) {
+	path := writeConfigFile(t, "dameon: app\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	assert.Error(t, loadConfigFile(defaultConfig(), path))
+}
+
+func TestFindConfigFile(t *testing.T) {
+	path := writeConfigFile(t, "cmd: true\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg := defaultConfig()
+	cfg.TargetDir = filepath.Dir(path)
+	found, err := findConfigFile(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, path, found)
+
+	cfg.ConfigFile = filepath.Join(cfg.TargetDir, "missing.yaml")
+	_, err = findConfigFile(cfg)
+	assert.Error(t, err)
+}
+
+func TestParseConfig(t *testing.T) {
+	path := writeConfigFile(t, `
+dir: src
+cmd: go install
+daemon: app
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// Flags set override the file, others keep the file's values.
+	cfg, found, err := parseConfig(flag.NewFlagSet("wago", flag.ContinueOnError),
+		[]string{"-config", path, "-cmd", "make"})
+	assert.NoError(t, err)
+	assert.Equal(t, path, found)
+	assert.Equal(t, "make", cfg.BuildCmd)
+	assert.Equal(t, "app", cfg.DaemonCmd)
+	assert.Equal(t, filepath.Join(filepath.Dir(path), "src"), cfg.TargetDir)
+
+	cfg, _, err = parseConfig(flag.NewFlagSet("wago", flag.ContinueOnError),
+		[]string{"-config", path, "-dir", "/tmp/other"})
+	assert.NoError(t, err)
+	assert.Equal(t, "go install", cfg.BuildCmd)
+	assert.Equal(t, "/tmp/other", cfg.TargetDir)
+
+	// The file is found in -dir.
+	cfg, found, err = parseConfig(flag.NewFlagSet("wago", flag.ContinueOnError),
+		[]string{"-dir", filepath.Dir(path)})
+	assert.NoError(t, err)
+	assert.Equal(t, path, found)
+	assert.Equal(t, filepath.Dir(path), cfg.TargetDir)
+	assert.Equal(t, "go install", cfg.BuildCmd)
+}
+
+func TestChainSteps(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BuildCmd = "go install"
+	cfg.DaemonCmd = "app"
+	cfg.DaemonTrigger = "Listening"
+	cfg.URL = "http://localhost:8420/"
+
+	steps, err := cfg.chainSteps()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Step{
+		{Name: "cmd", Kind: KindRunWait, Command: "go install"},
+		{Name: "daemon", Kind: KindDaemonTrigger, Command: "app", Trigger: "Listening",
+			Restart: RestartNever, MaxRestarts: 5},
+		{Name: "url", Kind: KindBrowser, URL: "http://localhost:8420/"},
+	}, steps)
+
+	path := writeConfigFile(t, `
+steps:
+  - name: codegen
+    command: go generate
+  - name: server
+    kind: DaemonTimer
+    command: app
+    timer: 500
+    restart: on-failure
+    backoff: 1s
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg = defaultConfig()
+	assert.NoError(t, loadConfigFile(cfg, path))
+	steps, err = cfg.chainSteps()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Step{
+		{Name: "codegen", Kind: KindRunWait, Command: "go generate"},
+		{Name: "server", Kind: KindDaemonTimer, Command: "app", Timer: 500,
+			Restart: RestartOnFailure, MaxRestarts: 5, Backoff: time.Second},
+	}, steps)
+
+	// Legacy flags can't be mixed with steps.
+	cfg.BuildCmd = "make"
+	_, err = cfg.chainSteps()
+	assert.Error(t, err)
+}
+
+// A ready timeout of 0 set by a step is kept, only a missing one is defaulted.
+func TestChainStepsReadyTimeout(t *testing.T) {
+	path := writeConfigFile(t, `
+steps:
+  - name: server
+    kind: DaemonReady
+    command: app
+    ready: tcp://localhost:8080
+    ready_timeout: 0
+  - name: worker
+    kind: DaemonReady
+    command: worker
+    ready: file:///tmp/worker.sock
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg := defaultConfig()
+	assert.NoError(t, loadConfigFile(cfg, path))
+	steps, err := cfg.chainSteps()
+	assert.NoError(t, err)
+	if assert.Len(t, steps, 2) {
+		assert.Equal(t, time.Duration(0), *steps[0].ReadyTimeout)
+		assert.Equal(t, 30*time.Second, *steps[1].ReadyTimeout)
+	}
+}
+
+func TestChainStepsInvalid(t *testing.T) {
+	tests := [][]*Step{
+		{{Command: "make"}},
+		{{Name: "a", Command: "make"}, {Name: "a", Command: "make"}},
+		{{Name: "a", Kind: "Daemon", Command: "app"}},
+		{{Name: "a", Kind: KindDaemonTrigger, Command: "app"}},
+		{{Name: "a", Kind: KindBrowser}},
+		{{Name: "a", Command: "make", Restart: RestartAlways}},
+		{{Name: "a", Kind: KindDaemonReady, Command: "app"}},
+		{{Name: "a", Kind: KindDaemonTrigger, Command: "app", Trigger: "("}},
+		{{Name: "a", Kind: KindDaemonTimer, Command: "app", FailTrigger: "FATAL"}},
+		{{Name: "a", Kind: KindDaemonTimer, Command: "app", Timeout: time.Second}},
+		{{Name: "a", Command: "make", StartTimeout: time.Second}},
+		{{Name: "a", Kind: KindDaemonReady, Command: "app", Ready: "localhost:8080"}},
+		{{Name: "a", Kind: KindDaemonTimer, Command: "app", Ready: "tcp://localhost:8080"}},
+		{{Name: "a", Kind: KindDaemonTimer, Command: "app", Restart: "sometimes"}},
+		{{Name: "a", Command: "make", Timer: 10}},
+		{{Name: "a", Command: "make", StopSignal: "STOP"}},
+		{{Name: "a", Command: "make", StopSequence: "INT 2s TERM", StopSignal: "INT"}},
+		{{Name: "a", Command: "make", StopSequence: "INT 2s", StopCommand: "make stop"}},
+		{{Name: "a", Kind: KindBrowser, URL: "http://localhost", StopSignal: "INT"}},
+		{{Name: "a", Command: "make", MemoryMax: "4G"}},
+		{{Name: "a", Kind: KindBrowser, URL: "http://localhost", PidsMax: 10}},
+	}
+
+	for _, steps := range tests {
+		cfg := defaultConfig()
+		cfg.Steps = steps
+		_, err := cfg.chainSteps()
+		assert.Error(t, err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Cgroup = "wago"
+	cfg.Steps = []*Step{{Name: "a", Command: "make", MemoryMax: "4GB"}}
+	_, err := cfg.chainSteps()
+	assert.Error(t, err)
+}
+
+func TestStepDeps(t *testing.T) {
+	steps := []*Step{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	deps, err := stepDeps(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int{nil, {0}, {1}}, deps)
+
+	steps[2].DependsOn = []string{"a", "b"}
+	deps, err = stepDeps(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int{nil, nil, {0, 1}}, deps)
+
+	steps[2].DependsOn = []string{"d"}
+	_, err = stepDeps(steps)
+	assert.Error(t, err)
+
+	steps[0].DependsOn = []string{"c"}
+	steps[2].DependsOn = []string{"b"}
+	steps[1].DependsOn = []string{"a"}
+	_, err = stepDeps(steps)
+	assert.Error(t, err)
+}
+
+func TestProjects(t *testing.T) {
+	path := writeConfigFile(t, `
+watch: 'CREATE$'
+projects:
+  - name: api
+    dir: api
+    steps:
+      - name: build
+        command: go build
+  - name: web
+    dir: /src/web
+    watch: 'WRITE$'
+    steps:
+      - name: build
+        command: npm run build
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg := defaultConfig()
+	assert.NoError(t, loadConfigFile(cfg, path))
+
+	projects, err := cfg.projects()
+	assert.NoError(t, err)
+	assert.Len(t, projects, 2)
+
+	assert.Equal(t, "api", projects[0].Name)
+	assert.Equal(t, filepath.Join(filepath.Dir(path), "api"), projects[0].TargetDir)
+	assert.Equal(t, "CREATE$", projects[0].WatchRegex)
+	assert.Equal(t, "go build", projects[0].Steps[0].Command)
+
+	assert.Equal(t, "web", projects[1].Name)
+	assert.Equal(t, "/src/web", projects[1].TargetDir)
+	assert.Equal(t, "WRITE$", projects[1].WatchRegex)
+	assert.Equal(t, "npm run build", projects[1].Steps[0].Command)
+
+	// The config itself isn't changed.
+	assert.Equal(t, "CREATE$", cfg.WatchRegex)
+
+	cfg.BuildCmd = "make"
+	_, err = cfg.projects()
+	assert.Error(t, err)
+}
+
+func TestProjectsInvalid(t *testing.T) {
+	tests := [][]*Project{
+		{{Dir: "api"}},
+		{{Name: "api"}},
+		{{Name: "api", Dir: "api"}, {Name: "api", Dir: "web"}},
+		{{Name: "api", Dir: "api", Steps: []*Step{{Name: "a"}}}},
+	}
+
+	for _, projects := range tests {
+		cfg := defaultConfig()
+		cfg.Projects = projects
+		_, err := cfg.projects()
+		assert.Error(t, err)
+	}
+}
+
+func TestProjectsDebounce(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Debounce = 150 * time.Millisecond
+	_, err := cfg.projects()
+	assert.NoError(t, err)
+
+	for _, max := range []time.Duration{0, 100 * time.Millisecond} {
+		cfg.DebounceMax = max
+		_, err := cfg.projects()
+		assert.Error(t, err)
+	}
+}
+
+func TestInDir(t *testing.T) {
+	assert.True(t, inDir("/src/api", "/src/api"))
+	assert.True(t, inDir("/src/api", "/src/api/main.go"))
+	assert.False(t, inDir("/src/api", "/src/web/main.go"))
+	assert.False(t, inDir("/src/api", "/src/apiary/main.go"))
+	assert.True(t, inDir("/src", "/src/..data/main.go"))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// controlAction is what a control asks the main loop of a project to do.
+type controlAction string
+
+// Control actions, typed by the user as :restart, :kill, :pause, :resume and
+// :status with -hotkeys. Pause and resume are also sent by SIGUSR1 and SIGUSR2
+// and the control API.
+const (
+	controlRestart controlAction = "restart"
+	controlKill    controlAction = "kill"
+	controlPause   controlAction = "pause"
+	controlResume  controlAction = "resume"
+	controlStatus  controlAction = "status"
+)
+
+// control is a command from the user to the main loop of every project, see
+// runChain.
+type control struct {
+	action controlAction
+	// step is the name or label of the step to act on, empty for the whole chain.
+	step string
+	// found receives from each project whether it has step, if it is not nil.
+	found chan bool
+}
+
+// parseControl parses the fields of a line typed by the user without its colon,
+// like restart server. It returns false if the line is not a control.
+func parseControl(fields []string) (control, bool) {
+	if len(fields) == 0 {
+		return control{}, false
+	}
+
+	ctl := control{action: controlAction(fields[0])}
+	switch {
+	case ctl.action == controlRestart && len(fields) <= 2:
+	case ctl.action == controlKill && len(fields) == 2:
+	case ctl.action == controlPause, ctl.action == controlResume, ctl.action == controlStatus:
+		if len(fields) != 1 {
+			return control{}, false
+		}
+	default:
+		return control{}, false
+	}
+
+	if len(fields) == 2 {
+		ctl.step = fields[1]
+	}
+	return ctl, true
+}
+
+// forwardControls sends each control to the controls of the projects, like
+// events. A control is never dropped, a resume in particular, unless Wago quits.
+// A control naming a step no project has is reported.
+func forwardControls(ctl control, projects []*Config, controls []chan<- control, quit chan struct{}) {
+	if ctl.step != "" {
+		ctl.found = make(chan bool, len(projects))
+	}
+
+	sent := 0
+	for i := range projects {
+		select {
+		case controls[i] <- ctl:
+			sent++
+		case <-quit:
+			return
+		}
+	}
+
+	if ctl.step == "" {
+		return
+	}
+
+	// Projects that have quit never answer, this goroutine then ends with Wago.
+	go func() {
+		for i := 0; i < sent; i++ {
+			if <-ctl.found {
+				return
+			}
+		}
+		log.Err("No step to "+string(ctl.action)+" (step):", ctl.step)
+	}()
+}
+
+// queueControls returns a channel whose controls are queued and sent to out in
+// order until quit is closed. Sending to it never waits for the receiver of out,
+// so the input goroutine, which the steps of a stopping project need, can't be
+// held up by a busy main loop, nor can one busy project hold up the others.
+func queueControls(out chan<- control, quit chan struct{}) chan<- control {
+	in := make(chan control)
+
+	go func() {
+		var queue []control
+		for {
+			// Sending to a nil channel blocks, so only a queued control is sent.
+			var send chan<- control
+			var next control
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+
+			select {
+			case ctl := <-in:
+				queue = append(queue, ctl)
+			case send <- next:
+				queue = queue[1:]
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return in
+}
+
+// controlHandler serves the control API of -control. POST /pause and /resume
+// pause and resume watching in every project.
+func controlHandler(ctls chan<- control) http.Handler {
+	mux := http.NewServeMux()
+
+	for _, action := range []controlAction{controlPause, controlResume} {
+		action := action
+		mux.HandleFunc("/"+string(action), func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Method not allowed, use POST.", http.StatusMethodNotAllowed)
+				return
+			}
+			ctls <- control{action: action}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+
+	return mux
+}
+
+// find returns the index of the step with name, or label if it is prefixed with
+// the project. It returns -1 if there is none.
+func (c *chain) find(name string) int {
+	for i, step := range c.steps {
+		if step.Name == name || (c.log != "" && string(c.log)+"/"+step.Name == name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// state describes the state of the current run of step i.
+func (c *chain) state(i int) string {
+	if c.finished[i] == nil {
+		return "not started"
+	}
+
+	select {
+	case <-c.finished[i]:
+	default:
+		return "starting"
+	}
+
+	if !c.ok[i] {
+		if c.kill[i] == nil {
+			return "killed"
+		}
+		return "failed"
+	}
+
+	select {
+	case <-c.stopped[i]:
+		if c.exited[i] {
+			return "exited"
+		}
+		return "done"
+	default:
+		return "running"
+	}
+}
+
+// status logs the state of every step and whether watching is paused.
+func (c *chain) status(paused bool) {
+	states := make([]string, len(c.steps))
+	for i, step := range c.steps {
+		states[i] = step.Name + ": " + c.state(i)
+	}
+	c.log.Info("Steps (paused, states):", paused, strings.Join(states, ", "))
+}
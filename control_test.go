@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseControl(t *testing.T) {
+	tests := []struct {
+		line string
+		ctl  control
+		ok   bool
+	}{
+		{"restart", control{action: controlRestart}, true},
+		{"restart server", control{action: controlRestart, step: "server"}, true},
+		{"kill api/server", control{action: controlKill, step: "api/server"}, true},
+		{"pause", control{action: controlPause}, true},
+		{"resume", control{action: controlResume}, true},
+		{"status", control{action: controlStatus}, true},
+		{"", control{}, false},
+		{"kill", control{}, false},
+		{"restart a b", control{}, false},
+		{"status server", control{}, false},
+		{"q", control{}, false},
+	}
+
+	for _, test := range tests {
+		ctl, ok := parseControl(strings.Fields(test.line))
+		assert.Equal(t, test.ok, ok, test.line)
+		assert.Equal(t, test.ctl, ctl, test.line)
+	}
+}
+
+func TestChainFind(t *testing.T) {
+	cfg := testConfig()
+	cfg.Name = "api"
+	c, err := newChain(cfg, []*Step{{Name: "build"}, {Name: "server"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, c.find("server"))
+	assert.Equal(t, 0, c.find("api/build"))
+	assert.Equal(t, -1, c.find("web/build"))
+	assert.Equal(t, -1, c.find("test"))
+	assert.Equal(t, "not started", c.state(0))
+}
+
+func TestControlHandler(t *testing.T) {
+	ctls := make(chan control, 1)
+	h := controlHandler(ctls)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/pause", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, control{action: controlPause}, <-ctls)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/resume", nil))
+	assert.Equal(t, control{action: controlResume}, <-ctls)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/pause", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/restart", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Len(t, ctls, 0)
+}
+
+// Controls wait for a busy project instead of being dropped, until Wago quits.
+func TestForwardControls(t *testing.T) {
+	projects := []*Config{testConfig()}
+	ctls := make(chan control)
+	controls := []chan<- control{ctls}
+	quit := make(chan struct{})
+
+	// A control is not dropped while the project is busy.
+	received := make(chan control, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		received <- <-ctls
+	}()
+	forwardControls(control{action: controlResume}, projects, controls, quit)
+	select {
+	case ctl := <-received:
+		assert.Equal(t, control{action: controlResume}, ctl)
+	case <-time.After(time.Second):
+		t.Fatal("Control not received")
+	}
+
+	// Once Wago quits, nothing receives and the control is dropped.
+	close(quit)
+	done := make(chan struct{})
+	go func() {
+		forwardControls(control{action: controlPause}, projects, controls, quit)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("forwardControls blocked after quit")
+	}
+}
+
+// Queued controls don't wait for the receiver and keep their order.
+func TestQueueControls(t *testing.T) {
+	out := make(chan control)
+	in := queueControls(out, nil)
+
+	sent := make(chan struct{})
+	go func() {
+		in <- control{action: controlPause}
+		in <- control{action: controlResume}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Sending a control waited for the receiver")
+	}
+
+	assert.Equal(t, control{action: controlPause}, <-out)
+	assert.Equal(t, control{action: controlResume}, <-out)
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"sync"
 	"syscall"
 	"time"
@@ -15,7 +17,8 @@ action chain a user defines for Wago.
 
 It takes a channel to receive a kill signal. When a file change occurs (or
 program exit), a kill signal is sent to the Runnable by closing the channel.
-Runnable then kills and cleans up the process.
+Runnable then kills and cleans up the process. It also takes the Run it is
+started for, which commands receive in their environment.
 
 It returns two channels:
 
@@ -28,16 +31,38 @@ It returns two channels:
   completely. All processes must be completely exited to ensure resources
   have been properly freed and the action chain can be safely started again.
 
-New Runnables are created with one of the three constructors:
-	NewRunWait, NewDaemonTimer, NewDaemonTrigger.
+New Runnables are created with one of the constructors:
+	NewRunWait, NewDaemonTimer, NewDaemonTrigger, NewDaemonReady.
 */
-type Runnable func(chan struct{}) (chan bool, chan struct{})
+type Runnable func(chan struct{}, *Run) (chan bool, chan struct{})
 
 // Cmd extends exec.Cmd to include channels and i/o necessary for advanced
 // process management.
 type Cmd struct {
 	*exec.Cmd
+	// Name is the name of the step the process was started for.
 	Name string
+
+	// log prefixes messages with the project name.
+	log prefixLog
+
+	// stop is how the process is stopped when it is killed.
+	stop *stopSpec
+	// stdout and stderr are where the output of the process is copied to, the
+	// output of Wago unless it is prefixed.
+	stdout io.Writer
+	stderr io.Writer
+
+	// pty is the master of the pseudo-terminal of the process, if it has one.
+	// tty is its slave, open until the process has started.
+	pty *os.File
+	tty *os.File
+	// descendants are all processes started by the process, also those outside
+	// its process group.
+	descendants *descendants
+	// cgroup contains the process and all of its descendants, if -cgroup is set.
+	cgroup *cgroup
+
 	done chan bool
 	dead chan struct{}
 
@@ -46,13 +71,30 @@ type Cmd struct {
 	Stderr io.ReadCloser
 }
 
+// cmdOptions are how the process of a step is run and stopped.
+type cmdOptions struct {
+	stop *stopSpec
+	// limits are used with -cgroup.
+	limits cgroupLimits
+	// pty runs the process attached to a pseudo-terminal instead of pipes.
+	pty bool
+	// prefix prefixes each line of output with the name of the step.
+	prefix bool
+}
+
 // newCmd is a constructor for Runnables to set up their internal exec.Cmd along
-// with channels to manage state and i/o pipes.
-func newCmd(command string) *Cmd {
+// with channels to manage state and i/o pipes. The environment describes run.
+// With -cgroup, the process is started in a new cgroup with limits.
+func newCmd(cfg *Config, name, command string, opts cmdOptions, run *Run) *Cmd {
 	cmd := &Cmd{
 		// -c is the POSIX switch for a shell to run a command
-		Cmd:  exec.Command(*shell, "-c", command),
-		Name: command,
+		Cmd:  exec.Command(cfg.Shell, "-c", command),
+		Name: name,
+		log:  prefixLog(cfg.Name),
+
+		stop:   opts.stop,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
 
 		// These channels will only be used once.
 		// done is buffered so that the send can always succeed and the Runnable can
@@ -62,6 +104,12 @@ func newCmd(command string) *Cmd {
 		dead: make(chan struct{}),
 	}
 
+	cmd.Env = append(os.Environ(), run.env(name)...)
+
+	if opts.prefix {
+		cmd.stdout, cmd.stderr = newPrefixWriters(cmd.label())
+	}
+
 	// Processes are set as a process group leader in a new process group. If it
 	// creates any child processes, they will also belong to the new group and
 	// allows us to kill all processes when necessary.
@@ -69,85 +117,212 @@ func newCmd(command string) *Cmd {
 		Setpgid: true,
 	}
 
+	if cfg.cgroup != "" {
+		cg, err := newCgroup(cfg.cgroup, name, opts.limits)
+		if err != nil {
+			cmd.log.Err("Error creating cgroup, running without (step, error):", cmd.Name, err)
+		} else {
+			cmd.cgroup = cg
+			cg.attach(cmd.SysProcAttr)
+		}
+	}
+
+	if opts.pty {
+		cmd.attachPTY()
+		return cmd
+	}
+
 	var err error
 	cmd.Stdin, err = cmd.StdinPipe()
 	if err != nil {
-		log.Fatal("Error making stdin (command, error):", cmd.Name, err)(9)
+		cmd.log.Fatal("Error making stdin (step, error):", cmd.Name, err)(9)
 	}
 	cmd.Stdout, err = cmd.StdoutPipe()
 	if err != nil {
-		log.Fatal("Error making stdout (command, error):", cmd.Name, err)(9)
+		cmd.log.Fatal("Error making stdout (step, error):", cmd.Name, err)(9)
 	}
 	cmd.Stderr, err = cmd.StderrPipe()
 	if err != nil {
-		log.Fatal("Error making stderr (command, error):", cmd.Name, err)(9)
+		cmd.log.Fatal("Error making stderr (step, error):", cmd.Name, err)(9)
 	}
 
 	return cmd
 }
 
+// label names the step of the process for the user, along with its project
+// when Wago manages more than one.
+func (cmd *Cmd) label() string {
+	if cmd.log == "" {
+		return cmd.Name
+	}
+	return string(cmd.log) + "/" + cmd.Name
+}
+
+// newTimeout returns a timer firing after d, or a timer that never fires if d
+// is 0.
+func newTimeout(d time.Duration) *time.Timer {
+	if d <= 0 {
+		t := time.NewTimer(time.Hour)
+		t.Stop()
+		return t
+	}
+	return time.NewTimer(d)
+}
+
 // kill nicely kills a process with escalating signals. This can only be called
 // after a process has actually been started and so is only called internally
 // by Runnables.
+//
+// Each stage of cmd.stop sends a signal to the process group and waits for the
+// process to exit. If there is a stop command, it is run instead of all but the
+// last stage (SIGKILL).
 func (cmd *Cmd) kill(proc chan error) {
-	log.Info("Sending signal SIGTERM to command:", cmd.Name)
-
 	pgid, err := syscall.Getpgid(cmd.Process.Pid)
 	if err != nil {
 		if err.Error() == "no such process" {
-			log.Info("Process exited before SIGTERM:", cmd.Name)
+			cmd.log.Info("Process exited before it was stopped:", cmd.Name)
 		} else {
-			log.Err("Error getting process group:", err)
+			cmd.log.Err("Error getting process group (step, error):", cmd.Name, err)
 		}
 		return
 	}
 
-	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
-		log.Warn("Failed to send SIGTERM, command must have exited (name, error):", cmd.Name, err)
-		return
+	stages, escalated := cmd.stop.stages, false
+	if cmd.stop.command != "" {
+		if cmd.runStopCommand(proc) {
+			return
+		}
+		stages, escalated = stages[len(stages)-1:], true
 	}
 
-	// Give process time to exit…
-	timerDone := make(chan struct{})
-	timer := time.AfterFunc(time.Duration(*exitWait)*time.Millisecond, func() {
-		close(timerDone)
-	})
+	for _, stage := range stages {
+		if !escalated {
+			cmd.log.Info("Sending signal to step (step, signal):", cmd.Name, stage.name)
+		} else {
+			cmd.log.Info("Step still running, sending signal (step, signal):", cmd.Name, stage.name)
+		}
+		escalated = true
 
-	select {
-	case <-timerDone:
-	case <-proc:
-		timer.Stop()
-		return
+		cmd.descendants.signal(pgid, stage.signal)
+		if stage.signal == syscall.SIGKILL && cmd.cgroup != nil {
+			cmd.cgroup.kill()
+		}
+		if err := syscall.Kill(-pgid, stage.signal); err != nil {
+			if err.Error() == "no such process" {
+				cmd.log.Info("Process exited before signal (step, signal):", cmd.Name, stage.name)
+			} else {
+				cmd.log.Err("Error signalling step (step, signal, error):", cmd.Name, stage.name, err)
+			}
+			return
+		}
+
+		if stage.wait == 0 {
+			continue
+		}
+
+		// Give process time to exit…
+		timer := time.NewTimer(stage.wait)
+		select {
+		case <-timer.C:
+		case <-proc:
+			timer.Stop()
+			return
+		}
 	}
+}
 
-	log.Info("After exitwait, command still running, sending SIGKILL…")
-	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
-		if err.Error() == "no such process" {
-			log.Info("Process exited before SIGKILL:", cmd.Name)
-		} else {
-			log.Err("Error killing command (cmd, error):", cmd.Name, err)
+// started starts tracking the descendants of the process once it has started
+// and closes what only the process needs.
+func (cmd *Cmd) started() {
+	if cmd.cgroup != nil {
+		cmd.cgroup.started()
+	}
+	if cmd.tty != nil {
+		cmd.tty.Close()
+	}
+	cmd.descendants = trackDescendants(cmd.Process.Pid)
+}
+
+// cleanup kills the descendants of the process that are still running after it
+// has exited, those that left its process group or were left behind, so that
+// they don't keep ports bound or files locked for the next run. The resources
+// used by the cgroup of the process are reported and it is removed, as is its
+// pseudo-terminal.
+func (cmd *Cmd) cleanup() {
+	for _, p := range cmd.descendants.kill() {
+		cmd.log.Warn("Killed orphaned process (step, pid, command):", cmd.Name, p.pid, p.comm)
+	}
+
+	if cmd.cgroup != nil {
+		// The cgroup also has the descendants that were not found.
+		if cmd.cgroup.populated() {
+			cmd.log.Warn("Killing processes left in cgroup of step:", cmd.Name)
+			cmd.cgroup.kill()
 		}
+		cmd.reportCgroup()
+		cmd.cgroup.remove()
+	}
+
+	if cmd.pty != nil {
+		closePTY(cmd.pty)
 	}
 }
 
-// NewRunWait constructs the Runnable RunWait.
-func NewRunWait(command string) Runnable {
-	return func(kill chan struct{}) (chan bool, chan struct{}) {
-		log.Info("Running command, waiting:", command)
+// runStopCommand runs the stop command of the step, then waits the grace period
+// of the first stage for the process to exit. It returns true if it has exited.
+func (cmd *Cmd) runStopCommand(proc chan error) bool {
+	cmd.log.Info("Running stop command (step, command):", cmd.Name, cmd.stop.command)
+
+	stop := exec.Command(cmd.stop.shell, "-c", cmd.stop.command)
+	stop.Env = append(cmd.Env, fmt.Sprint("WAGO_PID=", cmd.Process.Pid))
+	stop.Stdout = cmd.stdout
+	stop.Stderr = cmd.stderr
+
+	exited := make(chan error, 1)
+	if err := stop.Start(); err != nil {
+		cmd.log.Err("Error starting stop command (step, error):", cmd.Name, err)
+		return false
+	}
+	go func() { exited <- stop.Wait() }()
+
+	// The process may exit before the stop command does.
+	timer := time.NewTimer(cmd.stop.stages[0].wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			if err != nil {
+				cmd.log.Err("Stop command error (step, error):", cmd.Name, err)
+			}
+			exited = nil
+		case <-proc:
+			return true
+		case <-timer.C:
+			return false
+		}
+	}
+}
 
-		cmd := newCmd(command)
+// NewRunWait constructs the Runnable RunWait. A timeout of 0 waits forever.
+func NewRunWait(cfg *Config, name, command string, opts cmdOptions,
+	timeout time.Duration) Runnable {
+	return func(kill chan struct{}, run *Run) (chan bool, chan struct{}) {
+		cmd := newCmd(cfg, name, command, opts, run)
+		cmd.log.Info("Running command, waiting (step, command):", name, command)
 
-		go cmd.RunWait(kill)
+		go cmd.RunWait(kill, timeout)
 
 		return cmd.done, cmd.dead
 	}
 }
 
-// RunWait starts a process and signals done after the process has exited.
+// RunWait starts a process and signals done after the process has exited. If it
+// has not exited after timeout, it is killed and done is false.
 //
 // This is appropriate for actions like build commands which must complete successfully
 // for the action chain to continue.
-func (cmd *Cmd) RunWait(kill chan struct{}) {
+func (cmd *Cmd) RunWait(kill chan struct{}, timeout time.Duration) {
 	defer close(cmd.done)
 	defer close(cmd.dead)
 
@@ -156,9 +331,13 @@ func (cmd *Cmd) RunWait(kill chan struct{}) {
 		// This error is a program, system or environment error (shell is set wrong).
 		// Because it is not recoverable between builds, it is fatal. The user needs
 		// to adjust their system or command invocation.
-		log.Fatal("Error starting command:", err)(6)
+		cmd.log.Fatal("Error starting command (step, error):", cmd.Name, err)(6)
 	}
 
+	// Whatever is left of the process is killed before dead is closed.
+	cmd.started()
+	defer cmd.cleanup()
+
 	// The active process is now managed concurrently with signal management (below).
 	// proc signals the process exit by closing.
 	proc := make(chan error)
@@ -167,8 +346,8 @@ func (cmd *Cmd) RunWait(kill chan struct{}) {
 
 		// Subscribe to stdin, allows the process to receive input from the user.
 		subStdin <- cmd
-		copyPipe(cmd.Stdout, os.Stdout, &wg)
-		copyPipe(cmd.Stderr, os.Stderr, &wg)
+		copyPipe(cmd.Stdout, cmd.stdout, &wg)
+		copyPipe(cmd.Stderr, cmd.stderr, &wg)
 
 		// Wait for both copyPipes to finish. They will exit when the process has exited.
 		wg.Wait()
@@ -179,17 +358,24 @@ func (cmd *Cmd) RunWait(kill chan struct{}) {
 		close(proc)
 	}()
 
+	timer := newTimeout(timeout)
+	defer timer.Stop()
+
 	// We wait now for either the process to exit or a kill request. If the process
 	// exits, we return success status so that action chain can conditionally continue.
 	// If we receive a kill signal, the exit status no longer matters and isn't tracked.
 	select {
 	case err := <-proc:
 		if err != nil {
-			log.Err("Command error:", err)
+			cmd.log.Err("Command error (step, error):", cmd.Name, err)
 			cmd.done <- false
 		} else {
 			cmd.done <- true
 		}
+	case <-timer.C:
+		cmd.log.Err("Command timed out, killing (step, timeout):", cmd.Name, timeout)
+		cmd.done <- false
+		cmd.kill(proc)
 	case <-kill:
 		cmd.kill(proc)
 	}
@@ -201,11 +387,11 @@ func (cmd *Cmd) RunWait(kill chan struct{}) {
 }
 
 // NewDaemonTimer constructs the Runnable RunDaemonTimer.
-func NewDaemonTimer(command string, period int) Runnable {
-	return func(kill chan struct{}) (chan bool, chan struct{}) {
-		log.Info("Starting daemon:", command)
-
-		cmd := newCmd(command)
+func NewDaemonTimer(cfg *Config, name, command string, opts cmdOptions,
+	period int) Runnable {
+	return func(kill chan struct{}, run *Run) (chan bool, chan struct{}) {
+		cmd := newCmd(cfg, name, command, opts, run)
+		cmd.log.Info("Starting daemon (step, command):", name, command)
 
 		go cmd.RunDaemonTimer(kill, period)
 
@@ -230,9 +416,13 @@ func (cmd *Cmd) RunDaemonTimer(kill chan struct{}, period int) {
 		// This error is a program, system or environment error (shell is set wrong).
 		// Because it is not recoverable between builds, it is fatal. The user needs
 		// to adjust their system or command invocation.
-		log.Fatal("Error starting daemon:", err)(7)
+		cmd.log.Fatal("Error starting daemon (step, error):", cmd.Name, err)(7)
 	}
 
+	// Whatever is left of the process is killed before dead is closed.
+	cmd.started()
+	defer cmd.cleanup()
+
 	// The active process is now managed concurrently with signal management (below).
 	// proc signals the process exit by closing.
 	proc := make(chan error)
@@ -241,8 +431,8 @@ func (cmd *Cmd) RunDaemonTimer(kill chan struct{}, period int) {
 
 		// Subscribe to stdin, allows the process to receive input from the user.
 		subStdin <- cmd
-		copyPipe(cmd.Stdout, os.Stdout, &wg)
-		copyPipe(cmd.Stderr, os.Stderr, &wg)
+		copyPipe(cmd.Stdout, cmd.stdout, &wg)
+		copyPipe(cmd.Stderr, cmd.stderr, &wg)
 		wg.Wait()
 
 		unsubStdin <- cmd
@@ -254,7 +444,7 @@ func (cmd *Cmd) RunDaemonTimer(kill chan struct{}, period int) {
 	// timerDone signals by closing.
 	timerDone := make(chan struct{})
 
-	log.Debug("Waiting milliseconds:", period)
+	cmd.log.Debug("Waiting milliseconds:", period)
 	timer := time.AfterFunc(time.Duration(period)*time.Millisecond, func() {
 		close(timerDone)
 	})
@@ -262,7 +452,7 @@ func (cmd *Cmd) RunDaemonTimer(kill chan struct{}, period int) {
 	// Signal management.
 	select {
 	case <-timerDone:
-		log.Debug("Daemon timer done")
+		cmd.log.Debug("Daemon timer done:", cmd.Name)
 		cmd.done <- true
 
 		// Timer is done, but we still need to wait for an exit/kill. This nested
@@ -270,11 +460,11 @@ func (cmd *Cmd) RunDaemonTimer(kill chan struct{}, period int) {
 		select {
 		case err := <-proc:
 			if err != nil {
-				log.Err("Daemon error:", err)
+				cmd.log.Err("Daemon error (step, error):", cmd.Name, err)
 				cmd.done <- false
 			} else {
 				// A daemon probably shouldn't be exiting, warn the user.
-				log.Warn("Daemon exited cleanly")
+				cmd.log.Warn("Daemon exited cleanly:", cmd.Name)
 				cmd.done <- true
 			}
 		case <-kill:
@@ -284,10 +474,10 @@ func (cmd *Cmd) RunDaemonTimer(kill chan struct{}, period int) {
 	case err := <-proc:
 		timer.Stop()
 		if err != nil {
-			log.Err("Daemon error:", err)
+			cmd.log.Err("Daemon error (step, error):", cmd.Name, err)
 			cmd.done <- false
 		} else {
-			log.Warn("Daemon exited cleanly")
+			cmd.log.Warn("Daemon exited cleanly:", cmd.Name)
 			cmd.done <- true
 		}
 	case <-kill:
@@ -301,80 +491,163 @@ func (cmd *Cmd) RunDaemonTimer(kill chan struct{}, period int) {
 	<-proc
 }
 
-// NewDaemonTrigger constructs the Runnable RunDaemonTrigger.
-func NewDaemonTrigger(command string, trigger string) Runnable {
-	return func(kill chan struct{}) (chan bool, chan struct{}) {
-		log.Info("Starting daemon:", command)
+// NewDaemonReady constructs the Runnable RunDaemonReady.
+func NewDaemonReady(cfg *Config, name, command string, opts cmdOptions,
+	ready *probe, timeout time.Duration) Runnable {
+	return func(kill chan struct{}, run *Run) (chan bool, chan struct{}) {
+		cmd := newCmd(cfg, name, command, opts, run)
+		cmd.log.Info("Starting daemon (step, command):", name, command)
 
-		cmd := newCmd(command)
-
-		go cmd.RunDaemonTrigger(kill, trigger)
+		go cmd.RunDaemonReady(kill, ready, timeout)
 
 		return cmd.done, cmd.dead
 	}
 }
 
-// RunDaemonTrigger starts a daemon, waits until trigger is emitted by the process
-// stdout or stderr, then signals done for the action chain to continue.
+// RunDaemonReady starts a daemon, waits until the ready probe succeeds, then
+// signals done for the action chain to continue.
 //
-// This is useful for running daemons that have some setup and then output a ready
-// status like "Listening on port…"
-func (cmd *Cmd) RunDaemonTrigger(kill chan struct{}, trigger string) {
+// This is for daemons that don't output anything reliable once they are ready,
+// but listen on a port or create a socket. If the probe does not succeed within
+// timeout, the daemon is killed and done is false.
+func (cmd *Cmd) RunDaemonReady(kill chan struct{}, ready *probe, timeout time.Duration) {
 	defer close(cmd.done)
 	defer close(cmd.dead)
 
+	start := time.Now()
 	err := cmd.Start()
 	if err != nil {
-		log.Fatal("Error starting daemon:", err)(7)
+		cmd.log.Fatal("Error starting daemon (step, error):", cmd.Name, err)(7)
 	}
 
-	key := []byte(trigger)
-	match := make(chan struct{})
+	// Whatever is left of the process is killed before dead is closed.
+	cmd.started()
+	defer cmd.cleanup()
 
-	// watchPipe watches an output stream for the trigger text. When the trigger
-	// text is seen, it stops checking and simply copies.
-	//
-	// TODO: Consider abstracting further and moving to io.go.
-	// TODO: This reads one byte at a time. Intead, we should fill a buffer, similar
-	// to what ManageUserInput does.
-	watchPipe := func(in io.Reader, out io.Writer) {
-		b := make([]byte, 1)
-		spot := 0
-
-		for {
-			// Check for a trigger match
-			select {
-			case <-match:
-				// If there is a match, call io.Copy which will simply copy output to stdout
-				// until the process exits.
-				_, err := io.Copy(out, in)
-				if err != nil {
-					log.Err("Unwatched pipe has errored:", err)
-				}
-				return
-			default:
-				// If there is no match, fallthrough and check the next byte. This paradigm
-				// is necessary as len(chan) only works when chan is buffered.
-			}
+	// The active process is now managed concurrently with signal management (below).
+	// proc signals the process exit by closing.
+	proc := make(chan error)
+	go func() {
+		var wg sync.WaitGroup
 
-			n, err := in.Read(b)
-			if n > 0 {
-				out.Write(b[:n])
-				if b[0] == key[spot] {
-					spot++
-					if spot == len(key) {
-						log.Debug("Trigger match")
-						close(match)
-					}
-				}
-			}
+		// Subscribe to stdin, allows the process to receive input from the user.
+		subStdin <- cmd
+		copyPipe(cmd.Stdout, cmd.stdout, &wg)
+		copyPipe(cmd.Stderr, cmd.stderr, &wg)
+		wg.Wait()
+
+		unsubStdin <- cmd
+
+		proc <- cmd.Wait()
+		close(proc)
+	}()
+
+	// probeDone signals by closing, stopProbe stops probing early.
+	probeDone := make(chan struct{})
+	stopProbe := make(chan struct{})
+	defer close(stopProbe)
+
+	cmd.log.Debug("Waiting for ready probe (step, probe, timeout):", cmd.Name, ready.spec, timeout)
+	go ready.wait(probeDone, stopProbe, start)
+
+	timer := newTimeout(timeout)
+	defer timer.Stop()
+
+	// Signal management.
+	select {
+	case <-probeDone:
+		cmd.log.Debug("Daemon ready:", cmd.Name)
+		cmd.done <- true
+
+		// Probe succeeded, but we still need to wait for an exit/kill. This nested
+		// select duplicates the two cases of the parent select.
+		select {
+		case err := <-proc:
 			if err != nil {
-				if err.Error() != "EOF" {
-					log.Err("Watched pipe error:", err)
-				}
-				return
+				cmd.log.Err("Daemon error (step, error):", cmd.Name, err)
+				cmd.done <- false
+			} else {
+				// A daemon probably shouldn't be exiting, warn the user.
+				cmd.log.Warn("Daemon exited cleanly:", cmd.Name)
+				cmd.done <- true
 			}
+		case <-kill:
+			cmd.kill(proc)
 		}
+
+	case <-timer.C:
+		cmd.log.Err("Daemon not ready before timeout, killing (step, probe, timeout):",
+			cmd.Name, ready.spec, timeout)
+		cmd.done <- false
+		cmd.kill(proc)
+
+	case err := <-proc:
+		if err != nil {
+			cmd.log.Err("Daemon error (step, error):", cmd.Name, err)
+			cmd.done <- false
+		} else {
+			cmd.log.Warn("Daemon exited cleanly:", cmd.Name)
+			cmd.done <- true
+		}
+	case <-kill:
+		cmd.kill(proc)
+	}
+
+	// Runnables must not return until the process has exited completely.
+	<-proc
+}
+
+// NewDaemonTrigger constructs the Runnable RunDaemonTrigger. failTrigger may be
+// nil, a startTimeout of 0 waits forever.
+func NewDaemonTrigger(cfg *Config, name, command string, opts cmdOptions,
+	trigger, failTrigger *regexp.Regexp, startTimeout time.Duration) Runnable {
+	return func(kill chan struct{}, run *Run) (chan bool, chan struct{}) {
+		cmd := newCmd(cfg, name, command, opts, run)
+		cmd.log.Info("Starting daemon (step, command):", name, command)
+
+		go cmd.RunDaemonTrigger(kill, trigger, failTrigger, startTimeout)
+
+		return cmd.done, cmd.dead
+	}
+}
+
+// RunDaemonTrigger starts a daemon, waits until a line of the process stdout or
+// stderr matches trigger, then signals done for the action chain to continue.
+// If a line matches failTrigger first, or trigger is not matched within
+// startTimeout, the daemon is killed and done is false.
+//
+// This is useful for running daemons that have some setup and then output a ready
+// status like "Listening on port…"
+func (cmd *Cmd) RunDaemonTrigger(kill chan struct{}, trigger, failTrigger *regexp.Regexp,
+	startTimeout time.Duration) {
+	defer close(cmd.done)
+	defer close(cmd.dead)
+
+	err := cmd.Start()
+	if err != nil {
+		cmd.log.Fatal("Error starting daemon (step, error):", cmd.Name, err)(7)
+	}
+
+	// Whatever is left of the process is killed before dead is closed.
+	cmd.started()
+	defer cmd.cleanup()
+
+	// match and fail signal by closing, whichever comes first. Lines are matched
+	// by both pipes concurrently.
+	match := make(chan struct{})
+	fail := make(chan struct{})
+	var once sync.Once
+
+	patterns := []*regexp.Regexp{trigger, failTrigger}
+	found := func(i int) {
+		once.Do(func() {
+			if i == 0 {
+				cmd.log.Debug("Trigger match")
+				close(match)
+			} else {
+				close(fail)
+			}
+		})
 	}
 
 	// The active process is now managed concurrently with signal management (below).
@@ -385,27 +658,35 @@ func (cmd *Cmd) RunDaemonTrigger(kill chan struct{}, trigger string) {
 
 		// Subscribe to stdin, allows the process to receive input from the user.
 		subStdin <- cmd
-		wg.Add(2)
-		go func() {
-			watchPipe(cmd.Stdout, os.Stdout)
-			wg.Done()
-		}()
-		go func() {
-			watchPipe(cmd.Stderr, os.Stderr)
-			wg.Done()
-		}()
-
+		watchPipe(cmd.Stdout, cmd.stdout, patterns, found, &wg)
+		watchPipe(cmd.Stderr, cmd.stderr, patterns, found, &wg)
 		wg.Wait()
+
 		unsubStdin <- cmd
 
 		proc <- cmd.Wait()
 		close(proc)
 	}()
 
+	timer := newTimeout(startTimeout)
+	defer timer.Stop()
+
 	// Signal management.
 	select {
+	case <-fail:
+		cmd.log.Err("Daemon output matched fail trigger, killing (step, fail trigger):",
+			cmd.Name, failTrigger.String())
+		cmd.done <- false
+		cmd.kill(proc)
+
+	case <-timer.C:
+		cmd.log.Err("Daemon did not output trigger before timeout, killing (step, timeout):",
+			cmd.Name, startTimeout)
+		cmd.done <- false
+		cmd.kill(proc)
+
 	case <-match:
-		log.Debug("Daemon trigger matched")
+		cmd.log.Debug("Daemon trigger matched:", cmd.Name)
 		cmd.done <- true
 
 		// Trigger is matched and we have signaled done, but we still need to wait for
@@ -413,11 +694,11 @@ func (cmd *Cmd) RunDaemonTrigger(kill chan struct{}, trigger string) {
 		select {
 		case err := <-proc:
 			if err != nil {
-				log.Err("Daemon error:", err)
+				cmd.log.Err("Daemon error (step, error):", cmd.Name, err)
 				cmd.done <- false
 			} else {
 				// A daemon probably shouldn't be exiting, warn the user.
-				log.Warn("Daemon exited cleanly")
+				cmd.log.Warn("Daemon exited cleanly:", cmd.Name)
 				cmd.done <- true
 			}
 		case <-kill:
@@ -426,11 +707,11 @@ func (cmd *Cmd) RunDaemonTrigger(kill chan struct{}, trigger string) {
 
 	case err := <-proc:
 		if err != nil {
-			log.Err("Daemon error:", err)
+			cmd.log.Err("Daemon error (step, error):", cmd.Name, err)
 			cmd.done <- false
 		} else {
 			// A daemon probably shouldn't be exiting, warn the user.
-			log.Warn("Daemon exited cleanly")
+			cmd.log.Warn("Daemon exited cleanly:", cmd.Name)
 			cmd.done <- true
 		}
 	case <-kill:
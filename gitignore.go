@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Ignore files, in increasing order of precedence. .git/info/exclude is only
+// read in the top dir of a git repository.
+const (
+	gitExcludeFile = ".git/info/exclude"
+	gitIgnoreFile  = ".gitignore"
+	wagoIgnoreFile = ".wagoignore"
+)
+
+const (
+	// gitDir marks the top dir of a git repository.
+	gitDir = ".git"
+	// ignoreFileLimit is the size of the largest ignore file that will be read.
+	ignoreFileLimit = 1024 * 1024
+)
+
+// ignoreRule is one pattern of an ignore file, see gitignore(5).
+type ignoreRule struct {
+	// pattern is a glob relative to the dir of the ignore file.
+	pattern string
+	// negate re-includes a path excluded by an earlier rule.
+	negate bool
+	// dirOnly rules only match directories.
+	dirOnly bool
+	// anchored rules match the path relative to the dir of the ignore file,
+	// others match the base name at any depth.
+	anchored bool
+}
+
+// parseIgnore parses the rules of an ignore file.
+func parseIgnore(data []byte) []ignoreRule {
+	var rules []ignoreRule
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		rule := ignoreRule{}
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		// A slash at the start or in the middle anchors the pattern.
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+
+		if line == "" || validGlob(line) != nil {
+			continue
+		}
+
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// match reports whether the rule matches rel, a slash separated path relative to
+// the dir of the ignore file.
+func (rule ignoreRule) match(rel string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+
+	if rule.anchored {
+		return matchSegments(strings.Split(rule.pattern, "/"), strings.Split(rel, "/"))
+	}
+
+	ok, _ := path.Match(rule.pattern, path.Base(rel))
+	return ok
+}
+
+// ignorer decides whether paths within a project are excluded by .gitignore and
+// .wagoignore files. Like git, the ignore files of every dir from the top of the
+// git repository down to a path apply to it, deeper files taking precedence, and
+// nothing within an ignored dir can be re-included.
+//
+// Ignore files are read when first needed and reread after they change.
+type ignorer struct {
+	root      string
+	top       string
+	gitignore bool
+
+	mu    sync.Mutex
+	rules map[string][]ignoreRule
+	// dirs are the dirs names were checked for, so that a removed dir can still
+	// be told apart from a file, see ignoredEvent.
+	dirs map[string]struct{}
+}
+
+// newIgnorer constructs an ignorer for the dir of a project. .gitignore files are
+// only used if enabled by the user, .wagoignore files always are.
+func newIgnorer(cfg *Config) *ignorer {
+	ig := &ignorer{
+		root:      filepath.Clean(cfg.TargetDir),
+		gitignore: cfg.GitIgnore,
+		rules:     make(map[string][]ignoreRule),
+		dirs:      make(map[string]struct{}),
+	}
+
+	// Ignore files above the project apply too, up to the top of the repository.
+	ig.top = ig.root
+	if ig.gitignore {
+		for dir := ig.root; ; dir = filepath.Dir(dir) {
+			if _, err := os.Stat(filepath.Join(dir, gitDir)); err == nil {
+				ig.top = dir
+				break
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+
+	return ig
+}
+
+// ignorer returns the ignorer of the project, constructing it when first
+// needed.
+func (cfg *Config) ignorer() *ignorer {
+	if cfg.ig == nil {
+		cfg.ig = newIgnorer(cfg)
+	}
+	return cfg.ig
+}
+
+// ignored reports whether name is ignored. Names outside of the project and the
+// project dir itself are never ignored.
+func (ig *ignorer) ignored(name string, isDir bool) bool {
+	name = filepath.Clean(name)
+	if name == ig.root || !inDir(ig.root, name) {
+		return false
+	}
+
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+
+	if isDir {
+		ig.dirs[name] = struct{}{}
+	}
+
+	// Check each dir from the project down first, an ignored dir ignores all.
+	segments := strings.Split(relPath(ig.root, name), "/")
+	p := ig.root
+	for i, segment := range segments {
+		p = filepath.Join(p, segment)
+		if ig.match(p, isDir || i < len(segments)-1) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// match applies the rules of the ignore files in each dir from the top down to
+// the dir of name. The last matching rule decides.
+func (ig *ignorer) match(name string, isDir bool) bool {
+	ignored := false
+
+	parent := filepath.Dir(name)
+	dirs := []string{parent}
+	for dir := parent; dir != ig.top && inDir(ig.top, dir); {
+		dir = filepath.Dir(dir)
+		dirs = append(dirs, dir)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel := relPath(dirs[i], name)
+		for _, rule := range ig.load(dirs[i]) {
+			if rule.match(rel, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// load returns the rules of the ignore files in dir, reading them if necessary.
+// ig.mu must be held.
+func (ig *ignorer) load(dir string) []ignoreRule {
+	if rules, ok := ig.rules[dir]; ok {
+		return rules
+	}
+
+	files := []string{wagoIgnoreFile}
+	if ig.gitignore {
+		files = []string{gitIgnoreFile, wagoIgnoreFile}
+		if dir == ig.top {
+			files = []string{gitExcludeFile, gitIgnoreFile, wagoIgnoreFile}
+		}
+	}
+
+	var rules []ignoreRule
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || info.Size() > ignoreFileLimit {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Err("Error reading ignore file (path, error):", path, err)
+			continue
+		}
+
+		log.Debug("Using ignore file:", path)
+		rules = append(rules, parseIgnore(data)...)
+	}
+
+	ig.rules[dir] = rules
+	return rules
+}
+
+// update forgets the rules of ignore files changed by ev, they are reread when
+// next needed.
+func (ig *ignorer) update(ev fsnotify.Event) {
+	switch filepath.Base(ev.Name) {
+	case gitIgnoreFile, wagoIgnoreFile:
+	default:
+		return
+	}
+
+	ig.mu.Lock()
+	delete(ig.rules, filepath.Dir(ev.Name))
+	ig.mu.Unlock()
+}
+
+// ignoredEvent reports whether the path of ev is ignored. The path of a remove
+// or rename is gone, it is a dir if it was checked as one before.
+func (ig *ignorer) ignoredEvent(ev fsnotify.Event) bool {
+	info, err := os.Lstat(ev.Name)
+	if err == nil {
+		return ig.ignored(ev.Name, info.IsDir())
+	}
+
+	name := filepath.Clean(ev.Name)
+	ig.mu.Lock()
+	_, isDir := ig.dirs[name]
+	ig.mu.Unlock()
+
+	ignored := ig.ignored(name, isDir)
+
+	ig.mu.Lock()
+	delete(ig.dirs, name)
+	ig.mu.Unlock()
+
+	return ignored
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIgnore(t *testing.T) {
+	rules := parseIgnore([]byte(`
+# comment
+*.log
+!keep.log
+bin/
+/root.txt
+docs/*.md
+\#hash
+[
+`))
+
+	assert.Equal(t, []ignoreRule{
+		{pattern: "*.log"},
+		{pattern: "keep.log", negate: true},
+		{pattern: "bin", dirOnly: true},
+		{pattern: "root.txt", anchored: true},
+		{pattern: "docs/*.md", anchored: true},
+		{pattern: "#hash"},
+	}, rules)
+}
+
+func TestIgnorer(t *testing.T) {
+	top, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(top)
+
+	write := func(name, content string) {
+		path := filepath.Join(top, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	write(".git/info/exclude", "*.swp\n")
+	write(".gitignore", "*.log\nbin/\n/root.txt\nnode_modules\n")
+	write("api/.gitignore", "!keep.log\ngen/*.go\n")
+	write("api/.wagoignore", "*.tmp\n")
+	write("api/bin/.keep", "")
+
+	cfg := testConfig()
+	cfg.TargetDir = filepath.Join(top, "api")
+	ig := newIgnorer(cfg)
+	assert.Equal(t, top, ig.top)
+
+	p := func(name string) string { return filepath.Join(top, "api", name) }
+
+	tests := []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"main.go", false, false},
+		{"main.swp", false, true},
+		{"debug.log", false, true},
+		{"pkg/debug.log", false, true},
+		{"keep.log", false, false},
+		{"bin", true, true},
+		{"bin", false, false},
+		{"bin/app", false, true},
+		{"root.txt", false, false},
+		{"gen/a.go", false, true},
+		{"gen/sub/a.go", false, false},
+		{"a.tmp", false, true},
+		{"web/node_modules/x/index.js", false, true},
+		{"", true, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.ignored, ig.ignored(p(test.name), test.isDir), test.name)
+	}
+
+	// A removed dir is still matched by dir rules, a path never seen is not.
+	bin := fsnotify.Event{Name: p("bin"), Op: fsnotify.Create}
+	assert.True(t, ig.ignoredEvent(bin))
+	assert.NoError(t, os.RemoveAll(p("bin")))
+	bin.Op = fsnotify.Remove
+	assert.True(t, ig.ignoredEvent(bin))
+	assert.False(t, ig.ignoredEvent(fsnotify.Event{Name: p("pkg/bin"), Op: fsnotify.Remove}))
+
+	// Changed ignore files are reread.
+	write("api/.wagoignore", "")
+	ig.update(fsnotify.Event{Name: p(".wagoignore"), Op: fsnotify.Write})
+	assert.False(t, ig.ignored(p("a.tmp"), false))
+
+	// Without gitignore, only .wagoignore is used.
+	write("api/.wagoignore", "*.tmp\n")
+	cfg.GitIgnore = false
+	ig = newIgnorer(cfg)
+	assert.False(t, ig.ignored(p("debug.log"), false))
+	assert.True(t, ig.ignored(p("a.tmp"), false))
+}
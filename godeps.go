@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// goPackage is the part of the output of go list -json used by goDeps.
+type goPackage struct {
+	Dir        string
+	Standard   bool
+	GoFiles    []string
+	CgoFiles   []string
+	CFiles     []string
+	HFiles     []string
+	SFiles     []string
+	EmbedFiles []string
+	Module     *struct {
+		Main    bool
+		GoMod   string
+		Replace *struct {
+			Version string
+		}
+	}
+}
+
+// local reports whether the source of p can be edited by the user: it is part of
+// the main module or of a module replaced by a local dir. Packages of the
+// standard library and the module cache are not watched.
+func (p *goPackage) local() bool {
+	if p.Standard {
+		return false
+	}
+	if p.Module == nil {
+		// GOPATH mode.
+		return true
+	}
+	return p.Module.Main || (p.Module.Replace != nil && p.Module.Replace.Version == "")
+}
+
+// goDeps is the set of source files the Go packages of -go-deps depend on, as
+// reported by go list. The set is reloaded when go.mod or go.sum change, Go files
+// are added or removed or the imports of a Go file change.
+//
+// goDeps is safe for concurrent use, it is updated by the watcher and read by
+// projects.
+type goDeps struct {
+	log  prefixLog
+	dir  string
+	pkgs []string
+
+	mu sync.Mutex
+	// files are the source files of the packages.
+	files map[string]bool
+	// modFiles are go.mod and go.sum of local modules.
+	modFiles map[string]bool
+	// dirs are the dirs of files and modFiles.
+	dirs map[string]bool
+	// imports are the imports of each Go file, to know when to reload.
+	imports map[string]string
+}
+
+// loadGoDeps loads the Go dependencies of each project using -go-deps.
+func loadGoDeps(projects []*Config) error {
+	for _, cfg := range projects {
+		if cfg.GoDeps == "" {
+			continue
+		}
+
+		var err error
+		cfg.deps, err = newGoDeps(cfg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newGoDeps constructs the goDeps of a project, returning an error if go list
+// fails.
+func newGoDeps(cfg *Config) (*goDeps, error) {
+	d := &goDeps{
+		log:  prefixLog(cfg.Name),
+		dir:  cfg.TargetDir,
+		pkgs: strings.Fields(strings.Replace(cfg.GoDeps, ",", " ", -1)),
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load runs go list and replaces the set of files.
+func (d *goDeps) load() error {
+	args := append([]string{"list", "-e", "-deps", "-json"}, d.pkgs...)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = d.dir
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("go list %s: %v: %s", strings.Join(d.pkgs, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	files := make(map[string]bool)
+	modFiles := make(map[string]bool)
+	dirs := make(map[string]bool)
+	imports := make(map[string]string)
+
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var p goPackage
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("go list %s: %v", strings.Join(d.pkgs, " "), err)
+		}
+
+		if !p.local() || p.Dir == "" {
+			continue
+		}
+
+		dirs[p.Dir] = true
+
+		var names []string
+		for _, list := range [][]string{p.GoFiles, p.CgoFiles, p.CFiles, p.HFiles, p.SFiles, p.EmbedFiles} {
+			names = append(names, list...)
+		}
+		for _, name := range names {
+			name = filepath.Join(p.Dir, name)
+			files[name] = true
+			dirs[filepath.Dir(name)] = true
+
+			if strings.HasSuffix(name, ".go") {
+				imports[name] = goImports(name)
+			}
+		}
+
+		if p.Module != nil && p.Module.GoMod != "" {
+			modDir := filepath.Dir(p.Module.GoMod)
+			modFiles[p.Module.GoMod] = true
+			modFiles[filepath.Join(modDir, "go.sum")] = true
+			dirs[modDir] = true
+		}
+	}
+
+	d.log.Debug("Go dependencies loaded (files, dirs):", len(files), len(dirs))
+
+	d.mu.Lock()
+	d.files, d.modFiles, d.dirs, d.imports = files, modFiles, dirs, imports
+	d.mu.Unlock()
+
+	return nil
+}
+
+// goImports returns the imports of the Go file name, sorted and joined, or an
+// empty string if it can't be parsed.
+func goImports(name string) string {
+	f, err := parser.ParseFile(token.NewFileSet(), name, nil, parser.ImportsOnly)
+	if err != nil {
+		return ""
+	}
+
+	paths := make([]string, len(f.Imports))
+	for i, spec := range f.Imports {
+		paths[i] = spec.Path.Value
+	}
+	sort.Strings(paths)
+
+	return strings.Join(paths, " ")
+}
+
+// dirList returns the dirs to watch, sorted.
+func (d *goDeps) dirList() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dirs := make([]string, 0, len(d.dirs))
+	for dir := range d.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return dirs
+}
+
+// watches reports whether dir is one of the dirs to watch.
+func (d *goDeps) watches(dir string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.dirs[dir]
+}
+
+// match reports whether name is a dependency, go.mod or go.sum of a local module,
+// or a new Go file in the dir of a dependency which may become one.
+func (d *goDeps) match(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.files[name] || d.modFiles[name] || d.newGoFile(name)
+}
+
+// newGoFile reports whether name is a Go file, other than a test, in the dir of a
+// dependency. d.mu must be held.
+func (d *goDeps) newGoFile(name string) bool {
+	return d.dirs[filepath.Dir(name)] && strings.HasSuffix(name, ".go") &&
+		!strings.HasSuffix(name, "_test.go")
+}
+
+// update reloads the set of files if ev may have changed it, returning true if
+// it was reloaded. Errors of go list are logged and the previous set is kept.
+func (d *goDeps) update(ev fsnotify.Event) bool {
+	d.mu.Lock()
+	reload := d.modFiles[ev.Name]
+	if !reload && d.newGoFile(ev.Name) {
+		if ev.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+			reload = true
+		} else if ev.Op&fsnotify.Write != 0 {
+			imports, ok := d.imports[ev.Name]
+			reload = ok && imports != goImports(ev.Name)
+		}
+	}
+	d.mu.Unlock()
+
+	if !reload {
+		return false
+	}
+
+	d.log.Info("Reloading Go dependencies, changed:", ev.Name)
+	if err := d.load(); err != nil {
+		d.log.Err("Error reloading Go dependencies:", err)
+		return false
+	}
+	return true
+}
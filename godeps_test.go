@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGoDeps(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	top, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(top)
+
+	write := func(name, content string) string {
+		path := filepath.Join(top, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	write("app/go.mod", "module example.com/app\n\nrequire example.com/other v0.0.0\n\nreplace example.com/other => ../other\n")
+	server := write("app/cmd/server/main.go", "package main\n\nimport (\n\t\"fmt\"\n\t\"example.com/app/lib\"\n)\n\nfunc main() { fmt.Println(lib.A) }\n")
+	lib := write("app/lib/lib.go", "package lib\n\nimport \"example.com/other\"\n\nvar A = other.B\n")
+	write("app/lib/lib_test.go", "package lib\n")
+	unused := write("app/unused/unused.go", "package unused\n")
+	write("other/go.mod", "module example.com/other\n")
+	other := write("other/other.go", "package other\n\nvar B = 1\n")
+
+	cfg := testConfig()
+	cfg.TargetDir = filepath.Join(top, "app")
+	cfg.GoDeps = "./cmd/server"
+
+	d, err := newGoDeps(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{server, lib, other, filepath.Join(top, "app", "go.mod"), filepath.Join(top, "other", "go.sum")} {
+		assert.True(t, d.match(name), name)
+	}
+	assert.False(t, d.match(unused))
+	assert.False(t, d.match(filepath.Join(top, "app", "lib", "lib_test.go")))
+	assert.True(t, d.match(filepath.Join(top, "app", "lib", "new.go")))
+	assert.Equal(t, []string{
+		filepath.Join(top, "app"),
+		filepath.Join(top, "app", "cmd", "server"),
+		filepath.Join(top, "app", "lib"),
+		filepath.Join(top, "other"),
+	}, d.dirList())
+
+	// Changing code doesn't reload, changing imports does.
+	write("app/lib/lib.go", "package lib\n\nimport \"example.com/other\"\n\nvar A = other.B + 1\n")
+	assert.False(t, d.update(fsnotify.Event{Name: lib, Op: fsnotify.Write}))
+
+	write("app/lib/lib.go", "package lib\n\nimport _ \"example.com/app/unused\"\n\nvar A = 1\n")
+	assert.True(t, d.update(fsnotify.Event{Name: lib, Op: fsnotify.Write}))
+	assert.True(t, d.match(unused))
+	assert.False(t, d.match(other))
+}
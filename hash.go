@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// contentHashes remembers the hash of the contents of watched files, so that
+// writes which don't change a file (saving without changes, touch, formatters
+// rewriting identical bytes) can be ignored.
+type contentHashes struct {
+	// limit is the size of the largest file hashed, larger files are always
+	// considered changed.
+	limit  int64
+	hashes map[string][sha1.Size]byte
+}
+
+// newContentHashes constructs an empty contentHashes.
+func newContentHashes(limit int64) *contentHashes {
+	return &contentHashes{limit: limit, hashes: make(map[string][sha1.Size]byte)}
+}
+
+// prime hashes every file of a project matched by filter, so that the first
+// write to a file can already be compared.
+func (h *contentHashes) prime(cfg *Config, ig *ignorer, filter *eventFilter) error {
+	ignore, err := regexp.Compile(cfg.IgnoreRegex)
+	if err != nil {
+		return err
+	}
+
+	checkForHash := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() {
+			if path != cfg.TargetDir && (!cfg.Recursive || ignore.MatchString(path) || ig.ignored(path, true)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || ig.ignored(path, false) ||
+			!filter.match(fsnotify.Event{Name: path, Op: fsnotify.Write}) {
+			return nil
+		}
+
+		if hash, ok := hashFile(path, h.limit); ok {
+			h.hashes[path] = hash
+		}
+		return nil
+	}
+
+	// errors are handled in checkForHash
+	filepath.Walk(cfg.TargetDir, checkForHash)
+	return nil
+}
+
+// changed reports whether ev may have changed the contents of a file and
+// remembers the new hash. Only writes and chmods of files whose previous hash is
+// known and unchanged are reported as not changed.
+func (h *contentHashes) changed(ev fsnotify.Event) bool {
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(h.hashes, ev.Name)
+		return true
+	}
+
+	hash, ok := hashFile(ev.Name, h.limit)
+	if !ok {
+		delete(h.hashes, ev.Name)
+		return true
+	}
+
+	old, known := h.hashes[ev.Name]
+	h.hashes[ev.Name] = hash
+
+	if ev.Op&fsnotify.Create != 0 {
+		return true
+	}
+
+	return !known || old != hash
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "a.go")
+	big := filepath.Join(dir, "big.go")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("a"), 0644))
+	assert.NoError(t, ioutil.WriteFile(big, []byte("0123456789"), 0644))
+
+	cfg := testConfig()
+	cfg.TargetDir = dir
+	cfg.Include.Set("*.go")
+	filter, err := newEventFilter(cfg)
+	assert.NoError(t, err)
+
+	h := newContentHashes(5)
+	assert.NoError(t, h.prime(cfg, newIgnorer(cfg), filter))
+
+	write := fsnotify.Event{Name: file, Op: fsnotify.Write}
+
+	// Writing the same contents is not a change.
+	assert.NoError(t, ioutil.WriteFile(file, []byte("a"), 0644))
+	assert.False(t, h.changed(write))
+	assert.False(t, h.changed(fsnotify.Event{Name: file, Op: fsnotify.Chmod}))
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("b"), 0644))
+	assert.True(t, h.changed(write))
+	assert.False(t, h.changed(write))
+
+	// Creates and removes always are.
+	assert.True(t, h.changed(fsnotify.Event{Name: file, Op: fsnotify.Create}))
+	assert.True(t, h.changed(fsnotify.Event{Name: file, Op: fsnotify.Remove}))
+	assert.True(t, h.changed(write))
+
+	// Files larger than the limit are not hashed.
+	assert.True(t, h.changed(fsnotify.Event{Name: big, Op: fsnotify.Write}))
+	assert.True(t, h.changed(fsnotify.Event{Name: big, Op: fsnotify.Write}))
+}
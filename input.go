@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+)
+
+// focusKey is the key chord that moves input focus to the next running step,
+// Ctrl-] followed by Enter as the terminal sends input a line at a time.
+const focusKey = "\x1d"
+
+// inputRouter sends user input to one subscribed command at a time, the one that
+// has focus, instead of every running command.
+//
+// Focus is kept by the label of a step, so a restarted daemon gets it back.
+// While the focused step is not running, input is dropped and focus stays.
+//
+// With -hotkeys, lines like :restart are controls of the chain sent to control,
+// see parseControl. Other lines starting with a colon are input as usual.
+type inputRouter struct {
+	// subscribers are in the order they subscribed.
+	subscribers []*Cmd
+	focus       string
+
+	// control is nil without -hotkeys, sends to it don't wait for the main loops,
+	// see queueControls.
+	control chan<- control
+}
+
+// subscribe adds c, which gets focus if no step has it.
+func (r *inputRouter) subscribe(c *Cmd) {
+	r.subscribers = append(r.subscribers, c)
+	if r.focus == "" {
+		r.setFocus(c.label())
+	}
+}
+
+// unsubscribe removes c.
+func (r *inputRouter) unsubscribe(c *Cmd) {
+	for i, s := range r.subscribers {
+		if s == c {
+			r.subscribers = append(r.subscribers[:i], r.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// setFocus moves focus to the step label and tells the user.
+func (r *inputRouter) setFocus(label string) {
+	r.focus = label
+	log.Info("Input goes to step:", label)
+}
+
+// focused returns the command that has focus, nil if it is not running.
+func (r *inputRouter) focused() *Cmd {
+	for i := len(r.subscribers) - 1; i >= 0; i-- {
+		if r.subscribers[i].label() == r.focus {
+			return r.subscribers[i]
+		}
+	}
+	return nil
+}
+
+// input handles p, the input read at once from the user. A line with a meta
+// command like :focus is handled by Wago, anything else is written to the
+// command that has focus.
+func (r *inputRouter) input(p []byte) {
+	line := strings.TrimRight(string(p), "\r\n")
+
+	switch {
+	case line == focusKey:
+		r.focusNext()
+		return
+	case line == ":focus":
+		r.status()
+		return
+	case strings.HasPrefix(line, ":focus "):
+		r.focusStep(strings.TrimSpace(strings.TrimPrefix(line, ":focus ")))
+		return
+	case r.control != nil && strings.HasPrefix(line, ":") && r.hotkey(strings.Fields(line[1:])):
+		return
+	}
+
+	c := r.focused()
+	if c == nil {
+		log.Warn("No running step to send input to, input dropped.")
+		return
+	}
+
+	_, err := c.Stdin.Write(p)
+	if err != nil {
+		// While researching this I came across
+		// https://github.com/golang/go/issues/9307
+		// https://github.com/golang/go/issues/9173
+		// So we will prob just need to eat the error and keep going.
+		log.Err("Error writing stdin (cmd, error):", c.Name, err)
+	}
+}
+
+// hotkey handles the fields of a line typed after a colon. It returns false if
+// they are not a hotkey command, the line is then input.
+func (r *inputRouter) hotkey(fields []string) bool {
+	if len(fields) == 1 {
+		switch fields[0] {
+		case "verbose":
+			if log.toggleVerbose() {
+				log.Info("Verbose logging on.")
+			} else {
+				log.Info("Verbose logging off.")
+			}
+			return true
+		case "clear":
+			clearScreen()
+			return true
+		}
+	}
+
+	ctl, ok := parseControl(fields)
+	if !ok {
+		return false
+	}
+	if ctl.action == controlStatus {
+		r.status()
+	}
+	r.control <- ctl
+	return true
+}
+
+// labels returns the labels of the running steps, in the order they started.
+func (r *inputRouter) labels() []string {
+	var labels []string
+	seen := make(map[string]bool)
+	for _, c := range r.subscribers {
+		if label := c.label(); !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// status tells the user which step has focus and which steps are running.
+func (r *inputRouter) status() {
+	log.Info("Input goes to step (step, running steps):", r.focus, strings.Join(r.labels(), ", "))
+}
+
+// focusStep moves focus to the running step named name, by its label or step
+// name.
+func (r *inputRouter) focusStep(name string) {
+	for _, label := range r.labels() {
+		if label == name {
+			r.setFocus(label)
+			return
+		}
+	}
+	for _, c := range r.subscribers {
+		if c.Name == name {
+			r.setFocus(c.label())
+			return
+		}
+	}
+	log.Err("No running step to focus (step, running steps):", name, strings.Join(r.labels(), ", "))
+}
+
+// focusNext moves focus to the running step after the focused one.
+func (r *inputRouter) focusNext() {
+	labels := r.labels()
+	if len(labels) == 0 {
+		log.Warn("No running step to focus.")
+		return
+	}
+
+	next := labels[0]
+	for i, label := range labels {
+		if label == r.focus && i+1 < len(labels) {
+			next = labels[i+1]
+		}
+	}
+	r.setFocus(next)
+}
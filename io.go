@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"io"
+	"regexp"
 	"sync"
 )
 
@@ -17,22 +19,115 @@ func copyPipe(in io.Reader, out io.Writer, wg *sync.WaitGroup) {
 		if err != nil {
 			log.Err("I/O pipe has errored:", err)
 		}
+		flush(out)
 		wg.Done()
 	}()
 }
 
-// ManageUserInput passes bytes from user input to all subscribed commands.
-// Input is always os.Stdin
-func ManageUserInput(input io.Reader) (sub chan *Cmd, unsub chan *Cmd) {
+// flush writes what out holds back, like the partial line of a prefixWriter,
+// once the pipe to it has closed.
+func flush(out io.Writer) {
+	if f, ok := out.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+}
+
+// maxLine is the longest line a lineMatcher keeps, longer lines are truncated.
+const maxLine = 64 * 1024
+
+// ansiEscape matches the escape sequences of colors and cursor movement that
+// commands output in a terminal, see -pty. They are not matched by patterns.
+var ansiEscape = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// lineMatcher is a Writer that matches the lines written to it against regexes.
+// Output is copied through it by watchPipe, so it never delays output. A partial
+// line is matched as it is written too, so that prompts without a newline can
+// be matched.
+type lineMatcher struct {
+	patterns []*regexp.Regexp
+	// found is called with the index of the first pattern matching a line, at
+	// most once per line.
+	found func(i int)
+
+	line    []byte
+	matched bool
+}
+
+// Write matches each line in p, along with the partial line at its end.
+func (m *lineMatcher) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m.buffer(p)
+			m.match()
+			break
+		}
+
+		m.buffer(p[:i])
+		m.match()
+		m.line = m.line[:0]
+		m.matched = false
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+// buffer appends p to the current line.
+func (m *lineMatcher) buffer(p []byte) {
+	if room := maxLine - len(m.line); len(p) > room {
+		p = p[:room]
+	}
+	m.line = append(m.line, p...)
+}
+
+// match matches the current line unless it has already matched.
+func (m *lineMatcher) match() {
+	if m.matched || len(m.line) == 0 {
+		return
+	}
+
+	line := bytes.TrimSuffix(m.line, []byte("\r"))
+	if bytes.IndexByte(line, 0x1b) >= 0 {
+		line = ansiEscape.ReplaceAll(line, nil)
+	}
+	for i, re := range m.patterns {
+		if re != nil && re.Match(line) {
+			m.matched = true
+			m.found(i)
+			return
+		}
+	}
+}
+
+// watchPipe copies output from a process to out like copyPipe, matching each
+// line against patterns.
+func watchPipe(in io.Reader, out io.Writer, patterns []*regexp.Regexp, found func(i int), wg *sync.WaitGroup) {
+	wg.Add(1)
+
+	go func() {
+		m := &lineMatcher{patterns: patterns, found: found}
+		_, err := io.Copy(io.MultiWriter(out, m), in)
+		if err != nil {
+			log.Err("Watched pipe error:", err)
+		}
+		flush(out)
+		wg.Done()
+	}()
+}
+
+// ManageUserInput passes bytes from user input to the subscribed command that
+// has focus, see inputRouter. Input is always os.Stdin. Hotkey commands are sent
+// to ctls, nil disables them.
+func ManageUserInput(input io.Reader, ctls chan<- control) (sub chan *Cmd, unsub chan *Cmd) {
 	termIn := make(chan []byte)
 	ready := make(chan struct{})
 
 	sub = make(chan *Cmd)
 	unsub = make(chan *Cmd)
 
-	// Index with the pointer so they can easily be removed.
-	subscribers := make(map[*Cmd]struct{}, 2)
-
 	// endlessly read from terminal stdin
 	go func() {
 		p := make([]byte, 0, 4*1024)
@@ -64,28 +159,20 @@ func ManageUserInput(input io.Reader) (sub chan *Cmd, unsub chan *Cmd) {
 	}()
 
 	go func() {
-		var c *Cmd
-		var p []byte
-		var err error
+		r := &inputRouter{}
+		if ctls != nil {
+			r.control = queueControls(ctls, nil)
+		}
 
 		for {
 			select {
-			case p = <-termIn:
-				for c = range subscribers {
-					_, err = c.Stdin.Write(p)
-					if err != nil {
-						// While researching this I came across
-						// https://github.com/golang/go/issues/9307
-						// https://github.com/golang/go/issues/9173
-						// So we will prob just need to eat the error and keep going.
-						log.Err("Error writing stdin (cmd, error):", c.Name, err)
-					}
-				}
+			case p := <-termIn:
+				r.input(p)
 				ready <- struct{}{}
-			case c = <-sub:
-				subscribers[c] = struct{}{}
-			case c = <-unsub:
-				delete(subscribers, c)
+			case c := <-sub:
+				r.subscribe(c)
+			case c := <-unsub:
+				r.unsubscribe(c)
 			}
 		}
 	}()
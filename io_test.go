@@ -1,7 +1,14 @@
 package main
 
-import "testing"
-import "github.com/stretchr/testify/assert"
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 type ReadWriter struct {
 	Pipe chan []byte
@@ -32,8 +39,8 @@ func (rw *ReadWriter) Close() (err error) {
 	return nil
 }
 
-// Add and remove multiple processes, input should always reach all subscribed
-// processed.
+// Add and remove multiple processes, input should only reach the process that
+// has focus.
 func TestManageUserInput(t *testing.T) {
 	tests := [][]byte{
 		[]byte("foo bar"),
@@ -43,11 +50,12 @@ func TestManageUserInput(t *testing.T) {
 	}
 
 	mockUser := NewReadWriter()
-	sub, unsub := ManageUserInput(mockUser)
+	sub, unsub := ManageUserInput(mockUser, nil)
 
-	// Create and add first process
+	// Create and add first process, it gets focus.
 	cmdAMock := NewReadWriter()
 	cmdA := &Cmd{
+		Name:  "a",
 		Stdin: cmdAMock,
 	}
 	sub <- cmdA
@@ -58,45 +66,129 @@ func TestManageUserInput(t *testing.T) {
 		assert.Equal(t, tests[i], <-cmdAMock.Pipe)
 	}
 
-	// Add second process
+	// Add second and third process, focus stays with the first.
 	cmdBMock := NewReadWriter()
 	cmdB := &Cmd{
+		Name:  "b",
 		Stdin: cmdBMock,
 	}
 	sub <- cmdB
-
-	// Test both processes. Note input is only sent once
-	for i := range tests {
-		mockUser.Pipe <- tests[i]
-		assert.Equal(t, tests[i], <-cmdAMock.Pipe)
-		assert.Equal(t, tests[i], <-cmdBMock.Pipe)
-	}
-
-	// Add third proccess
 	cmdCMock := NewReadWriter()
 	cmdC := &Cmd{
+		Name:  "c",
 		Stdin: cmdCMock,
 	}
 	sub <- cmdC
 
-	// Test all three.
 	for i := range tests {
 		mockUser.Pipe <- tests[i]
 		assert.Equal(t, tests[i], <-cmdAMock.Pipe)
-		assert.Equal(t, tests[i], <-cmdBMock.Pipe)
+	}
+
+	// Focus the third by name, then the next one after it, the first.
+	mockUser.Pipe <- []byte(":focus c\n")
+	for i := range tests {
+		mockUser.Pipe <- tests[i]
 		assert.Equal(t, tests[i], <-cmdCMock.Pipe)
 	}
+	mockUser.Pipe <- []byte(focusKey + "\n")
+	mockUser.Pipe <- tests[0]
+	assert.Equal(t, tests[0], <-cmdAMock.Pipe)
 
 	unsub <- cmdA
 	// Close to check that no input is routed to the removed process
 	close(cmdAMock.Pipe)
 
-	for i := range tests {
-		mockUser.Pipe <- tests[i]
-		assert.Equal(t, tests[i], <-cmdBMock.Pipe)
-		assert.Equal(t, tests[i], <-cmdCMock.Pipe)
+	// Without the focused process, input is dropped and focus stays, so the
+	// restarted process gets the next input. The second status line only fits
+	// in the buffered pipe once the dropped input has been handled.
+	mockUser.Pipe <- tests[0]
+	mockUser.Pipe <- []byte(":focus\n")
+	mockUser.Pipe <- []byte(":focus\n")
+	cmdA2Mock := NewReadWriter()
+	sub <- &Cmd{Name: "a", Stdin: cmdA2Mock}
+	mockUser.Pipe <- tests[1]
+	assert.Equal(t, tests[1], <-cmdA2Mock.Pipe)
+	select {
+	case p := <-cmdCMock.Pipe:
+		t.Errorf("Unexpected input to c: %q", p)
+	default:
 	}
 
+	// A restarted process gets focus back.
+	mockUser.Pipe <- []byte(":focus b\n")
+	mockUser.Pipe <- tests[0]
+	assert.Equal(t, tests[0], <-cmdBMock.Pipe)
 	unsub <- cmdB
+	cmdB2Mock := NewReadWriter()
+	sub <- &Cmd{Name: "b", Stdin: cmdB2Mock}
+	mockUser.Pipe <- tests[0]
+	assert.Equal(t, tests[0], <-cmdB2Mock.Pipe)
+
 	unsub <- cmdC
 }
+
+// With hotkeys, controls are sent to the main loops and other lines, even those
+// starting with a colon, reach the process that has focus.
+func TestManageUserInputHotkeys(t *testing.T) {
+	mockUser := NewReadWriter()
+	ctls := make(chan control, 1)
+	sub, unsub := ManageUserInput(mockUser, ctls)
+
+	cmdAMock := NewReadWriter()
+	cmdA := &Cmd{
+		Name:  "a",
+		Stdin: cmdAMock,
+	}
+	sub <- cmdA
+
+	mockUser.Pipe <- []byte(":restart server\n")
+	assert.Equal(t, control{action: controlRestart, step: "server"}, <-ctls)
+	mockUser.Pipe <- []byte(":pause\r\n")
+	assert.Equal(t, control{action: controlPause}, <-ctls)
+
+	for _, line := range []string{":q\n", ":kill\n", ":pause now\n", "restart\n"} {
+		mockUser.Pipe <- []byte(line)
+		assert.Equal(t, []byte(line), <-cmdAMock.Pipe)
+	}
+
+	unsub <- cmdA
+}
+
+func TestLineMatcher(t *testing.T) {
+	var found []int
+	m := &lineMatcher{
+		patterns: []*regexp.Regexp{regexp.MustCompile(`aab`), nil, regexp.MustCompile(`^FATAL|in use$`)},
+		found:    func(i int) { found = append(found, i) },
+	}
+
+	// Matches overlapping prefixes and lines split across writes.
+	m.Write([]byte("xaaab\nFA"))
+	m.Write([]byte("TAL: x\r\nnothing\naddress in use\r\n"))
+	assert.Equal(t, []int{0, 2, 2}, found)
+
+	// A partial line is matched once, like a prompt.
+	m.Write([]byte("prompt aab"))
+	m.Write([]byte("> "))
+	m.Write([]byte("\n"))
+	assert.Equal(t, []int{0, 2, 2, 0}, found)
+
+	// Colors of commands in a pseudo-terminal are not matched.
+	m.Write([]byte("\x1b[1;31mFATAL\x1b[0m: x\r\n\x1b]0;title\x07address in \x1b[Kuse\r\n"))
+	assert.Equal(t, []int{0, 2, 2, 0, 2, 2}, found)
+}
+
+func TestWatchPipe(t *testing.T) {
+	var out bytes.Buffer
+	var wg sync.WaitGroup
+	matched := make(chan int, 1)
+
+	in := strings.NewReader("booting\nListening on :8080\n> ")
+	watchPipe(in, &out, []*regexp.Regexp{regexp.MustCompile(`Listening on :\d+`)},
+		func(i int) { matched <- i }, &wg)
+	wg.Wait()
+
+	// Output is copied unchanged, including the partial last line.
+	assert.Equal(t, "booting\nListening on :8080\n> ", out.String())
+	assert.Equal(t, 0, <-matched)
+}
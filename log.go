@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/JonahBraun/dog"
+)
+
+// switchLog is the logger of Wago. Its level set with -v or -q can be switched
+// to verbose and back while Wago runs, see the :verbose command.
+type switchLog struct {
+	dog     *dog.Dog
+	debug   *dog.Dog
+	verbose int32
+}
+
+// newSwitchLog returns a switchLog logging at level, a dog level.
+func newSwitchLog(level int) *switchLog {
+	return &switchLog{dog: dog.NewDog(level), debug: dog.NewDog(dog.DEBUG)}
+}
+
+// current returns the logger of the current level.
+func (l *switchLog) current() *dog.Dog {
+	if atomic.LoadInt32(&l.verbose) != 0 {
+		return l.debug
+	}
+	return l.dog
+}
+
+// toggleVerbose switches between verbose and the level Wago was started with.
+// It returns whether logging is now verbose. Only the input goroutine toggles.
+func (l *switchLog) toggleVerbose() bool {
+	verbose := atomic.LoadInt32(&l.verbose) == 0
+	if verbose {
+		atomic.StoreInt32(&l.verbose, 1)
+	} else {
+		atomic.StoreInt32(&l.verbose, 0)
+	}
+	return verbose
+}
+
+func (l *switchLog) Debug(v ...interface{}) { l.current().Debug(v...) }
+func (l *switchLog) Info(v ...interface{})  { l.current().Info(v...) }
+func (l *switchLog) Warn(v ...interface{})  { l.current().Warn(v...) }
+func (l *switchLog) Err(v ...interface{})   { l.current().Err(v...) }
+
+func (l *switchLog) Fatal(v ...interface{}) func(int) {
+	return l.current().Fatal(v...)
+}
+
+// prefixLog logs to log with a prefix, telling projects apart when Wago manages
+// more than one. The empty prefixLog logs without a prefix.
+type prefixLog string
+
+func (p prefixLog) args(v []interface{}) []interface{} {
+	if p == "" {
+		return v
+	}
+	return append([]interface{}{"[" + string(p) + "]"}, v...)
+}
+
+func (p prefixLog) Debug(v ...interface{}) { log.Debug(p.args(v)...) }
+func (p prefixLog) Info(v ...interface{})  { log.Info(p.args(v)...) }
+func (p prefixLog) Warn(v ...interface{})  { log.Warn(p.args(v)...) }
+func (p prefixLog) Err(v ...interface{})   { log.Err(p.args(v)...) }
+
+func (p prefixLog) Fatal(v ...interface{}) func(int) {
+	return log.Fatal(p.args(v)...)
+}
@@ -15,9 +15,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"regexp"
-	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/http2"
 
@@ -29,30 +28,9 @@ import (
 const VERSION = "1.3.1"
 
 var (
-	log     = dog.NewDog(dog.DEBUG)
-	verbose = flag.Bool("v", false, "Verbose")
-	quiet   = flag.Bool("q", false, "Quiet, only warnings and errors")
-
-	buildCmd      = flag.String("cmd", "", "Run command, wait for it to complete.")
-	daemonCmd     = flag.String("daemon", "", "Run command and leave running in the background.")
-	daemonTimer   = flag.Int("timer", 0, "Wait milliseconds after starting daemon, then continue.")
-	daemonTrigger = flag.String("trigger", "", "Wait for daemon to output this string, then continue.")
-	exitWait      = flag.Int("exitwait", 50, "Max milliseconds a process has after a SIGTERM to exit before a SIGKILL.")
-	fiddle        = flag.Bool("fiddle", false, "CLI fiddle mode! Start a web server, open browser to URL of targetDir/index.html")
-	postCmd       = flag.String("pcmd", "", "Run command after daemon starts. Use this to kick off your test suite.")
-	recursive     = flag.Bool("recursive", true, "Watch directory tree recursively.")
-	targetDir     = flag.String("dir", "", "Directory to watch, defaults to current.")
-	url           = flag.String("url", "", "Open browser to this URL after all commands are successful.")
-	watchRegex    = flag.String("watch", `/[^\.][^/]*": (CREATE|MODIFY$)`, "React to FS events matching regex. Use -v to see all events.")
-	ignoreRegex   = flag.String("ignore", `\.(git|hg|svn)`, "Ignore directories matching regex.")
-	httpPort      = flag.String("http", "", "Start a HTTP server on this port, e.g. :8420")
-	http2Port     = flag.String("h2", "", "Start a HTTP/TLS server on this port, e.g. :8421")
-	keyFile       = flag.String("key", "", "X.509 key file for HTTP2/TLS, eg: key.pem")
-	certFile      = flag.String("cert", "", "X.509 cert file for HTTP2/TLS, eg: cert.pem")
-	webRoot       = flag.String("webroot", "", "Local directory to use as root for web server, defaults to -dir.")
-	shell         = flag.String("shell", "", "Shell to interpret commands, defaults to $SHELL, fallback to /bin/sh")
-	subStdin      chan *Cmd
-	unsubStdin    chan *Cmd
+	log        = newSwitchLog(dog.DEBUG)
+	subStdin   chan *Cmd
+	unsubStdin chan *Cmd
 )
 
 // Watcher abstracts fsnotify.Watcher to facilitate testing with artifical events.
@@ -62,132 +40,307 @@ type Watcher struct {
 }
 
 func main() {
-	// TODO: Consider moving config variables to a config struct for code readability
-	// and further dependency injection.
-	configSetup()
+	cfg := configSetup()
 
 	// If necessary, start an http or http2 server.
-	startWebServer()
+	startWebServer(cfg)
+
+	// Controls from hotkeys, signals and the control API go to the main loops.
+	ctls := make(chan control)
+	catchPauseSignals(ctls)
+	startControlServer(cfg, ctls)
+
+	// Begin managing user input, which goes to the subscribed command that has
+	// focus, or to the main loops with -hotkeys.
+	var hotkeys chan control
+	if cfg.Hotkeys {
+		hotkeys = ctls
+	}
+	subStdin, unsubStdin = ManageUserInput(os.Stdin, hotkeys)
+
+	// Projects are copies of cfg and share its cgroup.
+	if err := setupCgroup(cfg); err != nil {
+		log.Fatal("Error setting up cgroup:", err)(1)
+	}
 
-	// Begin managing user input, which will broadcast to subscribed commands.
-	subStdin, unsubStdin = ManageUserInput(os.Stdin)
+	projects, err := cfg.projects()
+	if err != nil {
+		log.Fatal("Config error:", err)(1)
+	}
+	if err := loadGoDeps(projects); err != nil {
+		log.Fatal("Error finding Go dependencies:", err)(1)
+	}
 
-	// Setup action chain and run main loop.
-	runChain(newWatcher(), catchSignals())
+	// Setup the action chain of each project and run main loop.
+	runProjects(projects, newWatcher(projects), ctls, catchSignals())
 }
 
 // runChain creates the action chain and manages the main event loop.
-func runChain(watcher *Watcher, quit chan struct{}) {
-	chain := make([]Runnable, 0, 5)
+func runChain(cfg *Config, watcher *Watcher, ctls <-chan control, quit chan struct{}) {
+	plog := prefixLog(cfg.Name)
 
-	// Construct a chain of Runnables (user specified actions).
-	if len(*buildCmd) > 0 {
-		chain = append(chain, NewRunWait(*buildCmd))
+	steps, err := cfg.chainSteps()
+	if err != nil {
+		plog.Fatal("Config error:", err)(1)
 	}
-	if len(*daemonCmd) > 0 {
-		if len(*daemonTrigger) > 0 {
-			chain = append(chain, NewDaemonTrigger(*daemonCmd, *daemonTrigger))
-		} else {
-			chain = append(chain, NewDaemonTimer(*daemonCmd, *daemonTimer))
-		}
+
+	c, err := newChain(cfg, steps)
+	if err != nil {
+		plog.Fatal("Config error:", err)(1)
 	}
-	if len(*postCmd) > 0 {
-		chain = append(chain, NewRunWait(*postCmd))
+
+	filter, err := newEventFilter(cfg)
+	if err != nil {
+		plog.Fatal("Watch config error:", err)(1)
 	}
-	if *url != "" {
-		chain = append(chain, NewBrowser(*url))
+
+	ig := cfg.ignorer()
+
+	var hashes *contentHashes
+	if cfg.Hash {
+		hashes = newContentHashes(cfg.HashMax)
+		if err := hashes.prime(cfg, ig, filter); err != nil {
+			plog.Fatal("Ignore regex compile error:", err)(1)
+		}
 	}
 
-	eventRegex, err := regexp.Compile(*watchRegex)
-	if err != nil {
-		log.Fatal("Watch regex compile error:", err)(1)
+	// matchEvent returns the set of steps affected by ev, or nil if ev is ignored.
+	matchEvent := func(ev fsnotify.Event) []bool {
+		ig.update(ev)
+		if ig.ignoredEvent(ev) {
+			plog.Debug("Ignored event, path is in an ignore file:", ev.String())
+			return nil
+		}
+
+		if !filter.match(ev) {
+			plog.Debug("Ignored event:", ev.String())
+			return nil
+		}
+
+		if hashes != nil && !hashes.changed(ev) {
+			plog.Debug("Ignored event, contents unchanged:", ev.String())
+			return nil
+		}
+
+		affected := c.affected(relPath(cfg.TargetDir, ev.Name))
+		if c.names(affected) == "" {
+			plog.Debug("Event is not watched by any step:", ev.String())
+			return nil
+		}
+
+		plog.Info("Matched event:", ev.String())
+		return affected
 	}
 
-	var wg sync.WaitGroup
+	// settle adds the steps affected by further events to affected and the events
+	// to events until there have been no matching events for cfg.Debounce, or
+	// until cfg.DebounceMax has passed since the first event. It returns false if
+	// we should quit.
+	settle := func(affected []bool, events []fsnotify.Event) ([]fsnotify.Event, bool) {
+		quiet := time.After(cfg.Debounce)
+		max := time.After(cfg.DebounceMax)
 
-	// Main loop
-	for {
-		// Kill signals by closing. This allows it to broadcast to all Runnables and
-		// to the RunLoop below without the need for subscriber management.
-		//
-		// Because it signals by closing, a new channel needs to be created at the start
-		// of each loop.
-		kill := make(chan struct{})
-
-		// Events will cause the action chain to restart.
-		// Because we haven't started it yet, drain extra events.
-		var drain func()
-		drain = func() {
+		for {
 			select {
 			case ev := <-watcher.Event:
-				log.Debug("Extra event ignored:", ev.String())
-				drain()
-			default:
+				more := matchEvent(ev)
+				if more == nil {
+					continue
+				}
+				for i, in := range more {
+					affected[i] = affected[i] || in
+				}
+				events = append(events, ev)
+				quiet = time.After(cfg.Debounce)
+			case <-quiet:
+				return events, true
+			case <-max:
+				plog.Debug("Events did not settle within debouncemax, restarting")
+				return events, true
+			case err := <-watcher.Error:
+				plog.Fatal("Watcher error:", err)(5)
+			case <-quit:
+				return events, false
 			}
 		}
-		drain()
+	}
 
-		// Launch concurrent file loop. When an event is matched, the kill channel
-		// is closed. This signals to all active Runnables and the RunLoop below.
-		go func() {
-			for {
-				select {
-				case ev := <-watcher.Event:
-					if eventRegex.MatchString(ev.String()) {
-						log.Info("Matched event:", ev.String())
-						close(kill)
-						return
-					} else {
-						log.Debug("Ignored event:", ev.String())
-					}
-				case err = <-watcher.Error:
-					log.Fatal("Watcher error:", err)(5)
-				case <-quit:
-					close(kill)
-					return
-				}
-			}
-		}()
+	// Start the action chain. Steps run as soon as their dependencies are done.
+	run := newRun(plog, 1, nil)
+	defer func() { run.close() }()
+	c.start(c.all(), run)
 
-	RunLoop:
-		for _, runnable := range chain {
-			// Start the Runnable, which starts and manages a user defined process.
-			// Runnables may be running in parallel (a daemon and test suite).
-			done, dead := runnable(kill)
-			wg.Add(1)
-
-			go func() {
-				// Wait for the Runnable (process) to exit completely.
-				<-dead
-				wg.Done()
-			}()
-
-			// Wait for either an event to be received (<-kill) or for the Runnable to
-			// signal done. If done is successful, the next Runnable in the chain is started.
+	// drain adds the steps affected by the events that arrived while steps were
+	// stopped to affected and the events to events. It returns false if none
+	// matched.
+	drain := func(affected []bool, events []fsnotify.Event) ([]fsnotify.Event, bool) {
+		matched := false
+		for {
 			select {
-			case d := <-done:
-				if !d {
-					// Runnable's success metric failed, break out of the chain
-					break RunLoop
+			case ev := <-watcher.Event:
+				more := matchEvent(ev)
+				if more == nil {
+					continue
+				}
+				for i, in := range more {
+					affected[i] = affected[i] || in
 				}
-			case <-kill:
-				break RunLoop
+				events = append(events, ev)
+				matched = true
+			default:
+				return events, matched
 			}
 		}
+	}
 
-		// Ensure an event has occured, we may be here because all runnables signalled done.
-		<-kill
+	// restart kills the steps in set and starts them again for a new run of
+	// events. It returns false if we should quit.
+	restart := func(set []bool, events []fsnotify.Event) bool {
+		plog.Info("Restarting steps:", c.names(set))
 
-		// Ensure all runnables (procs) are dead before restarting the chain.
-		wg.Wait()
+		// Events that arrive while stopping are part of this restart, they may add
+		// steps that need stopping too.
+		c.stop(set)
+		for {
+			var matched bool
+			if events, matched = drain(set, events); !matched {
+				break
+			}
+			set = c.restartSet(set)
+			plog.Debug("More events matched, restarting steps:", c.names(set))
+			c.stop(set)
+		}
 
 		// Check if we should quit.
 		select {
 		case <-quit:
-			log.Debug("Quitting main event/action loop")
-			return
+			return false
 		default:
 		}
+
+		// Commands already started keep the environment of their run, its list of
+		// changed files is removed once none of them is running.
+		run.close()
+		run = newRun(plog, run.ID+1, events)
+		c.start(set, run)
+		return true
+	}
+
+	// While paused, the steps affected by matched events and the events are
+	// recorded in pending instead of restarting. Running steps are left alone.
+	// Events of the same file are collapsed into one, pendingFiles indexes them,
+	// so a long pause during a rebase does not grow without limit.
+	paused := false
+	var pending []bool
+	var pendingEvents []fsnotify.Event
+	var pendingFiles map[string]int
+
+	// Main loop. When an event is matched, the steps watching it are killed and
+	// restarted along with the steps downstream of them.
+	for {
+		select {
+		case ev := <-watcher.Event:
+			affected := matchEvent(ev)
+			if affected == nil {
+				continue
+			}
+			if paused {
+				if pending == nil {
+					pending = make([]bool, len(c.steps))
+					pendingFiles = make(map[string]int)
+				}
+				for i, in := range affected {
+					pending[i] = pending[i] || in
+				}
+				if i, ok := pendingFiles[ev.Name]; ok {
+					pendingEvents[i].Op |= ev.Op
+				} else {
+					pendingFiles[ev.Name] = len(pendingEvents)
+					pendingEvents = append(pendingEvents, ev)
+				}
+				plog.Info("Paused, restarting steps on resume:", c.names(pending))
+				continue
+			}
+
+			// Wait for the file system to be quiet, so that a burst of events from
+			// a single save or checkout results in a single restart.
+			events := []fsnotify.Event{ev}
+			if cfg.Debounce > 0 {
+				var ok bool
+				if events, ok = settle(affected, events); !ok {
+					plog.Debug("Quitting main event/action loop")
+					c.stop(c.all())
+					return
+				}
+			}
+
+			if !restart(c.restartSet(affected), events) {
+				plog.Debug("Quitting main event/action loop")
+				c.stop(c.all())
+				return
+			}
+
+		case ctl := <-ctls:
+			set := c.all()
+			if ctl.step != "" {
+				i := c.find(ctl.step)
+				// Only controls forwarded by forwardControls expect an answer.
+				if ctl.found != nil {
+					ctl.found <- i >= 0
+				}
+				if i < 0 {
+					continue
+				}
+				set = make([]bool, len(c.steps))
+				set[i] = true
+			}
+
+			switch ctl.action {
+			case controlRestart:
+				if !restart(c.restartSet(set), nil) {
+					plog.Debug("Quitting main event/action loop")
+					c.stop(c.all())
+					return
+				}
+			case controlKill:
+				plog.Info("Killing step:", c.names(set))
+				c.stop(set)
+			case controlPause:
+				if !paused {
+					paused = true
+					plog.Info("Paused, events are recorded until resumed.")
+				}
+			case controlResume:
+				if !paused {
+					continue
+				}
+				paused = false
+				if pending == nil {
+					plog.Info("Resumed, nothing changed.")
+					continue
+				}
+
+				// Everything matched while paused results in a single restart.
+				set, events := c.restartSet(pending), pendingEvents
+				pending, pendingEvents, pendingFiles = nil, nil, nil
+				plog.Info("Resumed.")
+				if !restart(set, events) {
+					plog.Debug("Quitting main event/action loop")
+					c.stop(c.all())
+					return
+				}
+			case controlStatus:
+				c.status(paused)
+			}
+
+		case err := <-watcher.Error:
+			plog.Fatal("Watcher error:", err)(5)
+
+		case <-quit:
+			plog.Debug("Quitting main event/action loop")
+			c.stop(c.all())
+			return
+		}
 	}
 }
 
@@ -208,87 +361,51 @@ func catchSignals() chan struct{} {
 	return quit
 }
 
-// newWatcher configures a fsnotify watcher for the user specified path. The returned
-// struct contains the two channels corresponding to those from the fsnotify package.
-func newWatcher() *Watcher {
-	// Create the local watcher from fsnotify. See wago_test.go where an artificial
-	// watcher is used instead.
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		panic(err)
-	}
-
-	ignore, err := regexp.Compile(*ignoreRegex)
-	if err != nil {
-		log.Fatal("Ignore regex compile error:", err)(1)
-	}
-
-	if _, err := os.Stat(*targetDir); err != nil {
-		log.Fatal("Directory does not exist (path, error):", *targetDir, err)(1)
-	}
-
-	// checkForWatch determines if a folder should be watched or not.
-	checkForWatch := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Err("Error reading dir, skipping:", path, err)
-			return filepath.SkipDir
-		}
-
-		if !info.IsDir() {
-			return nil
-		}
-
-		if ignore.MatchString(path) {
-			log.Debug("Ignoring dir:", path)
-			return filepath.SkipDir
-		}
+// catchPauseSignals pauses every project on SIGUSR1 and resumes them on SIGUSR2,
+// e.g. from git hooks around a rebase.
+func catchPauseSignals(ctls chan<- control) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
 
-		log.Debug("Watching dir:", path)
-		err = watcher.Add(path)
-		if err != nil {
-			log.Err("Error watching dir (path, error):", path, err)
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGUSR1 {
+				ctls <- control{action: controlPause}
+			} else {
+				ctls <- control{action: controlResume}
+			}
 		}
+	}()
+}
 
-		return nil
+// startControlServer starts the control API of every project if necessary.
+func startControlServer(cfg *Config, ctls chan<- control) {
+	if cfg.Control == "" {
+		return
 	}
 
-	if *recursive == true {
-		// errors are handled in checkForWatch
-		filepath.Walk(*targetDir, checkForWatch)
-	} else {
-		err = watcher.Add(*targetDir)
-		if err != nil {
-			log.Fatal("Error watching dir (path, error):", *targetDir, err)(1)
-		}
-	}
+	log.Info("Control API", cfg.Control)
 
-	// To facilitate testing (which sends artifical events from a timer),
-	// we have an abstracted struct Watcher that holds the applicable channels.
-	// Channels cannot be converted, an extra channel is required.
-	event := make(chan fsnotify.Event)
 	go func() {
-		for {
-			event <- <-watcher.Events
-		}
+		err := http.ListenAndServe(cfg.Control, controlHandler(ctls))
+		log.Fatal("Control API error:", err)(2)
 	}()
-
-	return &Watcher{event, watcher.Errors}
 }
 
 // startWebServer starts a local http/2 web server if necessary.
-func startWebServer() {
+func startWebServer(cfg *Config) {
 	var err error
 
-	if *webRoot == "" {
-		*webRoot = *targetDir
+	if cfg.WebRoot == "" {
+		cfg.WebRoot = cfg.TargetDir
 	}
 
-	if *httpPort != "" {
-		log.Info("HTTP port", *httpPort)
+	if cfg.HTTPPort != "" {
+		log.Info("HTTP port", cfg.HTTPPort)
 
 		s := &http.Server{
-			Addr:    *httpPort,
-			Handler: http.FileServer(http.Dir(*webRoot)),
+			Addr:    cfg.HTTPPort,
+			Handler: http.FileServer(http.Dir(cfg.WebRoot)),
 		}
 
 		http2.ConfigureServer(s, nil)
@@ -301,19 +418,19 @@ func startWebServer() {
 		}()
 	}
 
-	if *http2Port != "" {
-		log.Info("HTTP2 & TLS port", *http2Port)
+	if cfg.HTTP2Port != "" {
+		log.Info("HTTP2 & TLS port", cfg.HTTP2Port)
 
 		var key, cert []byte
-		if *keyFile == "" {
+		if cfg.KeyFile == "" {
 			key = []byte(x509Key)
 			cert = []byte(x509Cert)
 		} else {
-			key, err = ioutil.ReadFile(*keyFile)
+			key, err = ioutil.ReadFile(cfg.KeyFile)
 			if err != nil {
 				log.Fatal(err)(15)
 			}
-			cert, err = ioutil.ReadFile(*certFile)
+			cert, err = ioutil.ReadFile(cfg.CertFile)
 			if err != nil {
 				log.Fatal(err)(15)
 			}
@@ -328,8 +445,8 @@ func startWebServer() {
 		}
 
 		s := &http.Server{
-			Addr:      *http2Port,
-			Handler:   http.FileServer(http.Dir(*webRoot)),
+			Addr:      cfg.HTTP2Port,
+			Handler:   http.FileServer(http.Dir(cfg.WebRoot)),
 			TLSConfig: tlsConfig,
 		}
 
@@ -344,75 +461,84 @@ func startWebServer() {
 	}
 }
 
-// configSetup sets config variables from user params.
-func configSetup() {
+// configSetup builds the Config from an optional config file and user params.
+// Params override values from the config file.
+func configSetup() *Config {
 	flag.Usage = func() {
 		fmt.Println("WaGo (Watch, Go) build tool. Version", VERSION)
 		flag.PrintDefaults()
 	}
 
-	// TODO: this should check for actions
-	if len(os.Args) < 2 {
-		flag.Usage()
-		log.Fatal("You must specify an action")(1)
+	// flag.CommandLine exits on a parse error, so the error is the config file's.
+	cfg, path, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal("Config file error:", err)(1)
 	}
 
-	flag.Parse()
-
-	if *verbose {
-		log = dog.NewDog(dog.DEBUG)
-	} else if *quiet {
-		log = dog.NewDog(dog.WARN)
+	if cfg.Verbose {
+		log = newSwitchLog(dog.DEBUG)
+	} else if cfg.Quiet {
+		log = newSwitchLog(dog.WARN)
 	} else {
-		log = dog.NewDog(dog.INFO)
+		log = newSwitchLog(dog.INFO)
+	}
+
+	if path != "" {
+		log.Debug("Using config file", path)
 	}
 
-	if len(*shell) == 0 {
-		*shell = os.Getenv("SHELL")
-		if len(*shell) == 0 {
-			*shell = "/bin/sh"
+	if len(cfg.Shell) == 0 {
+		cfg.Shell = os.Getenv("SHELL")
+		if len(cfg.Shell) == 0 {
+			cfg.Shell = "/bin/sh"
 		}
 	}
-	log.Debug("Using shell", *shell)
+	log.Debug("Using shell", cfg.Shell)
 
-	if (len(*daemonTrigger) > 0) && (*daemonTimer > 0) {
+	if (len(cfg.DaemonTrigger) > 0) && (cfg.DaemonTimer > 0) {
 		log.Fatal("Both daemon trigger and timer specified, use only one")(1)
 	}
 
-	if (len(*daemonTrigger) > 0 || *daemonTimer > 0) && len(*daemonCmd) == 0 {
+	if (len(cfg.DaemonTrigger) > 0 || cfg.DaemonTimer > 0) && len(cfg.DaemonCmd) == 0 {
 		log.Fatal("Specify a daemon command to use the trigger or timer")(1)
 	}
 
-	if len(*buildCmd) == 0 && len(*daemonCmd) == 0 && !*fiddle &&
-		len(*postCmd) == 0 && len(*url) == 0 && len(*httpPort) == 0 &&
-		len(*http2Port) == 0 {
+	if len(cfg.BuildCmd) == 0 && len(cfg.DaemonCmd) == 0 && !cfg.Fiddle &&
+		len(cfg.PostCmd) == 0 && len(cfg.URL) == 0 && len(cfg.HTTPPort) == 0 &&
+		len(cfg.HTTP2Port) == 0 && len(cfg.Steps) == 0 && len(cfg.Projects) == 0 {
 		flag.Usage()
 		log.Fatal("You must specify an action")(1)
 	}
 
-	if *fiddle {
-		if *httpPort == "" {
-			*httpPort = ":8420"
+	if cfg.Fiddle {
+		if cfg.HTTPPort == "" {
+			cfg.HTTPPort = ":8420"
 		}
-		if *http2Port == "" {
-			*http2Port = ":8421"
+		if cfg.HTTP2Port == "" {
+			cfg.HTTP2Port = ":8421"
 		}
-		if *url == "" {
-			*url = "http://localhost" + *httpPort + "/"
+		if cfg.URL == "" && len(cfg.Steps) == 0 && len(cfg.Projects) == 0 {
+			cfg.URL = "http://localhost" + cfg.HTTPPort + "/"
 		}
 	}
 
-	if *targetDir == "" {
+	if cfg.TargetDir == "" {
 		cwd, err := os.Getwd()
 		if err != nil {
 			panic(err)
 		}
-		targetDir = &cwd
+		cfg.TargetDir = cwd
 	}
 
-	if (*keyFile != "" && *certFile == "") || (*certFile != "" && *keyFile == "") {
+	if _, err := cfg.projects(); err != nil {
+		log.Fatal("Config error:", err)(1)
+	}
+
+	if (cfg.KeyFile != "" && cfg.CertFile == "") || (cfg.CertFile != "" && cfg.KeyFile == "") {
 		log.Fatal("Set both key and cert or none to use default.")(1)
 	}
 
-	log.Debug("Target dir:", *targetDir)
+	log.Debug("Target dir:", cfg.TargetDir)
+
+	return cfg
 }
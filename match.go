@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// matchGlob reports whether name, a slash separated path relative to the watch
+// root, matches the glob pattern.
+//
+// Pattern segments are matched with path.Match and a "**" segment matches any
+// number of directories. A pattern without a slash matches the base name at
+// any depth, so "*.css" matches "web/css/main.css".
+func matchGlob(pattern, name string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments matches path segments against pattern segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try matching the rest of the pattern at every remaining depth.
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// validGlob returns an error if pattern is malformed.
+func validGlob(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("%s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// relPath returns name relative to root with slash separators. Names outside of
+// root are returned unchanged.
+func relPath(root, name string) string {
+	if !inDir(root, name) {
+		return filepath.ToSlash(name)
+	}
+
+	rel, _ := filepath.Rel(root, name)
+	return filepath.ToSlash(rel)
+}
+
+// scope is the set of paths a step watches, by glob or regex. An empty scope
+// matches every path.
+type scope struct {
+	globs []string
+	regex *regexp.Regexp
+}
+
+// newScope constructs a scope, returning an error for bad patterns.
+func newScope(globs []string, regex string) (*scope, error) {
+	s := &scope{globs: globs}
+
+	for _, glob := range globs {
+		if err := validGlob(glob); err != nil {
+			return nil, err
+		}
+	}
+
+	if regex != "" {
+		var err error
+		s.regex, err = regexp.Compile(regex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// match reports whether the relative path name is in scope.
+func (s *scope) match(name string) bool {
+	if len(s.globs) == 0 && s.regex == nil {
+		return true
+	}
+
+	for _, glob := range s.globs {
+		if matchGlob(glob, name) {
+			return true
+		}
+	}
+
+	return s.regex != nil && s.regex.MatchString(name)
+}
+
+// globList is a comma separated list of globs, as a flag.
+type globList []string
+
+func (l *globList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *globList) Set(value string) error {
+	*l = nil
+	for _, glob := range strings.Split(value, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			*l = append(*l, glob)
+		}
+	}
+	return nil
+}
+
+// eventOps are the names of fsnotify.Op used by -ops.
+var eventOps = map[string]fsnotify.Op{
+	"create": fsnotify.Create,
+	"write":  fsnotify.Write,
+	"remove": fsnotify.Remove,
+	"rename": fsnotify.Rename,
+	"chmod":  fsnotify.Chmod,
+}
+
+// defaultOps are used when globs are set without -ops.
+const defaultOps = fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename
+
+// parseOps parses a comma separated list of op names.
+func parseOps(ops string) (fsnotify.Op, error) {
+	var op fsnotify.Op
+	for _, name := range strings.Split(ops, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		o, ok := eventOps[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown op %q", name)
+		}
+		op |= o
+	}
+	return op, nil
+}
+
+// eventFilter decides which events are acted on. If any of -include, -exclude
+// or -ops is set, events are matched by the path relative to the watch root and
+// their op. Otherwise the -watch regex is matched against the event string.
+type eventFilter struct {
+	root  string
+	regex *regexp.Regexp
+
+	structured bool
+	include    []string
+	exclude    []string
+	ops        fsnotify.Op
+
+	// deps limits events to Go dependencies, if set.
+	deps *goDeps
+}
+
+// newEventFilter constructs the eventFilter of a project, returning an error for
+// bad patterns.
+func newEventFilter(cfg *Config) (*eventFilter, error) {
+	f := &eventFilter{
+		root:       cfg.TargetDir,
+		structured: len(cfg.Include) > 0 || len(cfg.Exclude) > 0 || cfg.Ops != "" || cfg.GoDeps != "",
+		include:    cfg.Include,
+		exclude:    cfg.Exclude,
+		ops:        defaultOps,
+		deps:       cfg.deps,
+	}
+
+	if !f.structured {
+		var err error
+		f.regex, err = regexp.Compile(cfg.WatchRegex)
+		if err != nil {
+			return nil, fmt.Errorf("watch regex: %v", err)
+		}
+		return f, nil
+	}
+
+	for _, glob := range append(f.include, f.exclude...) {
+		if err := validGlob(glob); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Ops != "" {
+		var err error
+		f.ops, err = parseOps(cfg.Ops)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// match reports whether ev should be acted on.
+func (f *eventFilter) match(ev fsnotify.Event) bool {
+	if !f.structured {
+		return f.regex.MatchString(ev.String())
+	}
+
+	if ev.Op&f.ops == 0 {
+		return false
+	}
+
+	if f.deps != nil && !f.deps.match(ev.Name) {
+		return false
+	}
+
+	name := relPath(f.root, ev.Name)
+
+	for _, glob := range f.exclude {
+		if matchGlob(glob, name) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, glob := range f.include {
+		if matchGlob(glob, name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.css", "main.css", true},
+		{"*.css", "web/css/main.css", true},
+		{"*.css", "main.go", false},
+		{"web/*.css", "web/main.css", true},
+		{"web/*.css", "web/css/main.css", false},
+		{"/web/*.css", "web/main.css", true},
+		{"web/**", "web/css/main.css", true},
+		{"web/**", "api/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "cmd/server/main.go", true},
+		{"**/*_gen.go", "cmd/server/main.go", false},
+		{"cmd/**/main.go", "cmd/main.go", true},
+		{"cmd/**/main.go", "cmd/a/b/main.go", true},
+		{"cmd/**/main.go", "cmd/a/b/other.go", false},
+		{"[a-c].txt", "b.txt", true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.match, matchGlob(test.pattern, test.name), test.pattern+" "+test.name)
+	}
+}
+
+func TestScope(t *testing.T) {
+	s, err := newScope(nil, "")
+	assert.NoError(t, err)
+	assert.True(t, s.match("anything.txt"))
+
+	s, err = newScope([]string{"*.css", "web/**"}, `\.scss$`)
+	assert.NoError(t, err)
+	assert.True(t, s.match("style/main.css"))
+	assert.True(t, s.match("web/index.html"))
+	assert.True(t, s.match("style/main.scss"))
+	assert.False(t, s.match("main.go"))
+
+	_, err = newScope([]string{"[a-"}, "")
+	assert.Error(t, err)
+	_, err = newScope(nil, "(")
+	assert.Error(t, err)
+}
+
+func TestRelPath(t *testing.T) {
+	assert.Equal(t, "web/main.css", relPath("/src", "/src/web/main.css"))
+	assert.Equal(t, "/other/main.css", relPath("/src", "/other/main.css"))
+}
+
+func TestEventFilter(t *testing.T) {
+	cfg := testConfig()
+	cfg.TargetDir = "/src"
+
+	// Legacy regex.
+	f, err := newEventFilter(cfg)
+	assert.NoError(t, err)
+	assert.True(t, f.match(fsnotify.Event{Name: "/src/main.go", Op: fsnotify.Create}))
+	assert.False(t, f.match(fsnotify.Event{Name: "/src/.main.go", Op: fsnotify.Create}))
+
+	cfg.Include.Set("**/*.go, *.tmpl")
+	cfg.Exclude.Set("**/*_gen.go")
+	f, err = newEventFilter(cfg)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		ev    fsnotify.Event
+		match bool
+	}{
+		{fsnotify.Event{Name: "/src/main.go", Op: fsnotify.Write}, true},
+		{fsnotify.Event{Name: "/src/cmd/server/main.go", Op: fsnotify.Create}, true},
+		{fsnotify.Event{Name: "/src/web/index.tmpl", Op: fsnotify.Remove}, true},
+		{fsnotify.Event{Name: "/src/model_gen.go", Op: fsnotify.Write}, false},
+		{fsnotify.Event{Name: "/src/readme.md", Op: fsnotify.Write}, false},
+		{fsnotify.Event{Name: "/src/main.go", Op: fsnotify.Chmod}, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.match, f.match(test.ev), test.ev.String())
+	}
+
+	cfg.Ops = "create,chmod"
+	f, err = newEventFilter(cfg)
+	assert.NoError(t, err)
+	assert.False(t, f.match(fsnotify.Event{Name: "/src/main.go", Op: fsnotify.Write}))
+	assert.True(t, f.match(fsnotify.Event{Name: "/src/main.go", Op: fsnotify.Chmod}))
+
+	cfg.Ops = "modify"
+	_, err = newEventFilter(cfg)
+	assert.Error(t, err)
+}
+
+func TestGlobList(t *testing.T) {
+	var l globList
+	assert.NoError(t, l.Set("**/*.go, web/**,"))
+	assert.Equal(t, globList{"**/*.go", "web/**"}, l)
+	assert.Equal(t, "**/*.go,web/**", l.String())
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// partialWait is how long a partial line is held back for the rest of the line
+// before it is written anyway, so that prompts like iex(1)> are shown.
+const partialWait = 100 * time.Millisecond
+
+// prefixColors are the colors of step names, picked by a hash of the name.
+// Red is the marker of stderr.
+var prefixColors = []int{36, 33, 32, 35, 34, 96, 93, 92, 95, 94}
+
+// output serializes the lines written by all prefixWriters. open is the writer
+// whose partial line is the last output, if any, other writers start a new line.
+var output struct {
+	sync.Mutex
+	open *prefixWriter
+}
+
+// prefixWriter writes the output of a command line by line, each line prefixed
+// with the name of its step, so that the output of concurrent commands does not
+// interleave within lines.
+type prefixWriter struct {
+	out    io.Writer
+	prefix []byte
+
+	// mu guards partial and timer, which flushes the partial line.
+	mu      sync.Mutex
+	partial []byte
+	timer   *time.Timer
+}
+
+// newPrefixWriters returns the writers of stdout and stderr of the step name.
+// The name is colored if Wago writes to a terminal, the prefix of stderr has a
+// red ! marker.
+func newPrefixWriters(name string) (stdout, stderr *prefixWriter) {
+	if !colorOutput() {
+		return &prefixWriter{out: os.Stdout, prefix: []byte("[" + name + "] ")},
+			&prefixWriter{out: os.Stderr, prefix: []byte("[" + name + "]! ")}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	color := prefixColors[h.Sum32()%uint32(len(prefixColors))]
+
+	return &prefixWriter{out: os.Stdout, prefix: []byte(fmt.Sprintf("\x1b[%dm[%s]\x1b[0m ", color, name))},
+		&prefixWriter{out: os.Stderr, prefix: []byte(fmt.Sprintf("\x1b[%dm[%s]\x1b[31;1m!\x1b[0m ", color, name))}
+}
+
+// colorOutput reports whether stdout is a terminal and NO_COLOR is not set.
+func colorOutput() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Write writes the complete lines in p and holds back a partial line at its end
+// for up to partialWait.
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+
+	if i := bytes.LastIndexByte(w.partial, '\n'); i >= 0 {
+		w.write(w.partial[:i+1])
+		w.partial = append(w.partial[:0], w.partial[i+1:]...)
+	}
+
+	switch {
+	case len(w.partial) >= maxLine:
+		w.write(w.partial)
+		w.partial = w.partial[:0]
+	case len(w.partial) > 0 && w.timer == nil:
+		w.timer = time.AfterFunc(partialWait, w.Flush)
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the partial line, if any.
+func (w *prefixWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.partial) > 0 {
+		w.write(w.partial)
+		w.partial = w.partial[:0]
+	}
+}
+
+// write writes p, prefixing each line. A partial line this writer wrote last is
+// continued without a prefix. w.mu must be held.
+func (w *prefixWriter) write(p []byte) {
+	output.Lock()
+	defer output.Unlock()
+
+	var buf bytes.Buffer
+	if output.open != nil && output.open != w {
+		buf.WriteByte('\n')
+	}
+
+	start := output.open == w
+	for len(p) > 0 {
+		if !start {
+			buf.Write(w.prefix)
+		}
+		start = false
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			buf.Write(p)
+			break
+		}
+		buf.Write(p[:i+1])
+		p = p[i+1:]
+	}
+
+	output.open = nil
+	if buf.Len() > 0 && buf.Bytes()[buf.Len()-1] != '\n' {
+		output.open = w
+	}
+
+	w.out.Write(buf.Bytes())
+}
+
+// clearScreen clears the terminal of Wago. A partial line of a step is not
+// continued afterwards.
+func clearScreen() {
+	output.Lock()
+	defer output.Unlock()
+
+	output.open = nil
+	os.Stdout.Write([]byte("\x1b[H\x1b[2J"))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	a := &prefixWriter{out: &out, prefix: []byte("[a] ")}
+	b := &prefixWriter{out: &out, prefix: []byte("[b]! ")}
+
+	// Lines are not interleaved, the partial line waits for the rest.
+	a.Write([]byte("a1\na2"))
+	b.Write([]byte("b1\nb2\n"))
+	a.Write([]byte(" end\n"))
+	assert.Equal(t, "[a] a1\n[b]! b1\n[b]! b2\n[a] a2 end\n", out.String())
+
+	// A prompt is written after partialWait and continued without prefix.
+	out.Reset()
+	a.Write([]byte("iex(1)> "))
+	time.Sleep(2 * partialWait)
+	output.Lock()
+	assert.Equal(t, "[a] iex(1)> ", out.String())
+	output.Unlock()
+	a.Write([]byte("1 + 1\n2\n"))
+	assert.Equal(t, "[a] iex(1)> 1 + 1\n[a] 2\n", out.String())
+
+	// Other output starts on a new line after a prompt.
+	out.Reset()
+	a.Write([]byte("> "))
+	a.Flush()
+	b.Write([]byte("error\n"))
+	a.Write([]byte("x\n"))
+	assert.Equal(t, "[a] > \n[b]! error\n[a] x\n", out.String())
+}
+
+func TestNewPrefixWriters(t *testing.T) {
+	os.Setenv("NO_COLOR", "1")
+	defer os.Unsetenv("NO_COLOR")
+
+	stdout, stderr := newPrefixWriters("web/server")
+	assert.Equal(t, "[web/server] ", string(stdout.prefix))
+	assert.Equal(t, "[web/server]! ", string(stderr.prefix))
+	assert.Equal(t, os.Stderr, stderr.out)
+}
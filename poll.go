@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileState is what polling knows about a file or dir from the last scan.
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+	hash    [sha1.Size]byte
+}
+
+// pollWatcher finds changes by periodically scanning the watched dirs with stat,
+// for file systems where fsnotify does not get events (NFS, Docker bind mounts,
+// VirtualBox shared folders). Changes are sent as fsnotify events.
+type pollWatcher struct {
+	roots []*watchRoot
+	hash  bool
+
+	// files is the state of every file and dir of the last scan.
+	files map[string]fileState
+}
+
+// newPollWatcher starts polling the user specified path of each project every
+// interval. If hash is set, file contents are hashed to detect changes that
+// don't change the modification time or size.
+func newPollWatcher(roots []*watchRoot, interval time.Duration, hash bool) *Watcher {
+	log.Info("Polling for changes every", interval)
+
+	p := &pollWatcher{roots: roots, hash: hash}
+	p.files = p.scan()
+
+	watcher := &Watcher{make(chan fsnotify.Event), make(chan error)}
+
+	go func() {
+		for range time.Tick(interval) {
+			files := p.scan()
+			for _, ev := range p.diff(files) {
+				for _, root := range p.roots {
+					root.ig.update(ev)
+					if root.cfg.deps != nil {
+						root.cfg.deps.update(ev)
+					}
+				}
+				watcher.Event <- ev
+			}
+			p.files = files
+		}
+	}()
+
+	return watcher
+}
+
+// scan returns the state of every watched file and dir.
+func (p *pollWatcher) scan() map[string]fileState {
+	files := make(map[string]fileState, len(p.files))
+
+	for _, root := range p.roots {
+		// The dirs of Go dependencies are scanned without their subdirs.
+		if root.cfg.deps != nil {
+			for _, dir := range root.cfg.deps.dirList() {
+				p.scanDir(dir, files)
+			}
+			continue
+		}
+
+		// checkForWatch determines if a path should be watched or not.
+		checkForWatch := func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Files are expected to disappear between reading a dir and stat.
+				if !os.IsNotExist(err) {
+					root.log.Debug("Error reading, skipping (path, error):", path, err)
+				}
+				return nil
+			}
+
+			if path != root.cfg.TargetDir {
+				if info.IsDir() && (root.ignore.MatchString(path) || root.ig.ignored(path, true)) {
+					return filepath.SkipDir
+				}
+
+				if !root.cfg.Recursive && filepath.Dir(path) != filepath.Clean(root.cfg.TargetDir) {
+					return filepath.SkipDir
+				}
+			}
+
+			files[path] = p.state(path, info)
+			return nil
+		}
+
+		filepath.Walk(root.cfg.TargetDir, checkForWatch)
+	}
+
+	return files
+}
+
+// scanDir adds the state of dir and the files in it to files.
+func (p *pollWatcher) scanDir(dir string, files map[string]fileState) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+	files[dir] = p.state(dir, info)
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Debug("Error reading, skipping (path, error):", dir, err)
+		return
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		files[path] = p.state(path, info)
+	}
+}
+
+// state returns the fileState of path.
+func (p *pollWatcher) state(path string, info os.FileInfo) fileState {
+	state := fileState{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		mode:    info.Mode(),
+	}
+
+	if p.hash && info.Mode().IsRegular() {
+		old, ok := p.files[path]
+		// Only hash files that may have changed, hashing is expensive.
+		if ok && old.modTime.Equal(state.modTime) && old.size == state.size {
+			state.hash = old.hash
+		} else {
+			state.hash, _ = hashFile(path, -1)
+		}
+	}
+
+	return state
+}
+
+// diff returns events for the differences between the last scan and files, in
+// path order.
+func (p *pollWatcher) diff(files map[string]fileState) []fsnotify.Event {
+	var events []fsnotify.Event
+
+	for path, state := range files {
+		old, ok := p.files[path]
+
+		switch {
+		case !ok:
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		case state.mode.IsRegular() && (!state.modTime.Equal(old.modTime) ||
+			state.size != old.size || state.hash != old.hash):
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+		case state.mode != old.mode:
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Chmod})
+		}
+	}
+
+	for path := range p.files {
+		if _, ok := files[path]; !ok {
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Name < events[j].Name
+	})
+
+	return events
+}
+
+// hashFile returns the SHA-1 of the contents of the file at path. Files larger
+// than limit bytes are not hashed and ok is false. A negative limit hashes files
+// of any size.
+func hashFile(path string, limit int64) (hash [sha1.Size]byte, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return hash, false
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if limit >= 0 {
+		// Read one more byte than the limit to know if the file is too large.
+		r = io.LimitReader(f, limit+1)
+	}
+
+	h := sha1.New()
+	n, err := io.Copy(h, r)
+	if err != nil || (limit >= 0 && n > limit) {
+		return hash, false
+	}
+
+	copy(hash[:], h.Sum(nil))
+	return hash, true
+}
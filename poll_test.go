@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollDiff(t *testing.T) {
+	now := time.Now()
+	p := &pollWatcher{files: map[string]fileState{
+		"/src/a.go": {modTime: now, size: 1, mode: 0644},
+		"/src/b.go": {modTime: now, size: 1, mode: 0644},
+		"/src/c.go": {modTime: now, size: 1, mode: 0644},
+		"/src/d.go": {modTime: now, size: 1, mode: 0644},
+		"/src/e.go": {modTime: now, size: 1, mode: 0644, hash: [20]byte{1}},
+	}}
+
+	events := p.diff(map[string]fileState{
+		"/src/a.go": {modTime: now, size: 1, mode: 0644},
+		"/src/b.go": {modTime: now, size: 2, mode: 0644},
+		"/src/c.go": {modTime: now, size: 1, mode: 0755},
+		"/src/e.go": {modTime: now, size: 1, mode: 0644, hash: [20]byte{2}},
+		"/src/f.go": {modTime: now, size: 1, mode: 0644},
+	})
+
+	assert.Equal(t, []fsnotify.Event{
+		{Name: "/src/b.go", Op: fsnotify.Write},
+		{Name: "/src/c.go", Op: fsnotify.Chmod},
+		{Name: "/src/d.go", Op: fsnotify.Remove},
+		{Name: "/src/e.go", Op: fsnotify.Write},
+		{Name: "/src/f.go", Op: fsnotify.Create},
+	}, events)
+}
+
+func TestPollWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig()
+	cfg.TargetDir = dir
+	cfg.Poll = 10 * time.Millisecond
+	watcher := newWatcher([]*Config{cfg})
+
+	sub := filepath.Join(dir, "sub")
+	assert.NoError(t, os.Mkdir(sub, 0755))
+	expectEvent(t, watcher, sub)
+
+	file := filepath.Join(sub, "a.txt")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("a"), 0644))
+	expectEvent(t, watcher, file)
+
+	assert.NoError(t, os.Remove(file))
+	expectEvent(t, watcher, file)
+}
+
+func TestHashFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("abc")
+	f.Close()
+
+	a, ok := hashFile(f.Name(), -1)
+	assert.True(t, ok)
+	b, ok := hashFile(f.Name(), 3)
+	assert.True(t, ok)
+	assert.Equal(t, a, b)
+
+	_, ok = hashFile(f.Name(), 2)
+	assert.False(t, ok)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// probeInterval is the time between checks of a probe.
+	probeInterval = 100 * time.Millisecond
+	// probeTimeout limits a single check of a probe.
+	probeTimeout = time.Second
+)
+
+// probe checks whether a daemon is ready. Probes are written as a URL:
+//
+//	tcp://localhost:8080        a TCP port accepts connections
+//	http://localhost:8080/ping  an HTTP GET returns the expected status
+//	file:///tmp/app.sock        a file or socket is created or modified
+type probe struct {
+	spec   string
+	scheme string
+	target string
+	status int
+}
+
+// parseProbe parses spec, status is the HTTP status expected by http probes.
+func parseProbe(spec string, status int) (*probe, error) {
+	i := strings.Index(spec, "://")
+	if i < 0 {
+		return nil, fmt.Errorf("ready probe %q: expected tcp://, http://, https:// or file://", spec)
+	}
+
+	p := &probe{spec: spec, scheme: spec[:i], target: spec[i+3:], status: status}
+	if p.status == 0 {
+		p.status = http.StatusOK
+	}
+
+	switch p.scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(p.target); err != nil {
+			return nil, fmt.Errorf("ready probe %q: %v", spec, err)
+		}
+	case "http", "https":
+		p.target = spec
+	case "file":
+		if p.target == "" {
+			return nil, fmt.Errorf("ready probe %q: path is required", spec)
+		}
+	default:
+		return nil, fmt.Errorf("ready probe %q: unknown scheme %q", spec, p.scheme)
+	}
+
+	return p, nil
+}
+
+// check reports whether the probe succeeds now. A file must have been modified
+// since, so that one left by a previous run of the daemon is not taken for
+// ready.
+func (p *probe) check(since time.Time) bool {
+	switch p.scheme {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", p.target, probeTimeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+
+	case "http", "https":
+		client := http.Client{Timeout: probeTimeout}
+		resp, err := client.Get(p.target)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == p.status
+
+	default:
+		info, err := os.Stat(p.target)
+		if err != nil {
+			return false
+		}
+		// File times may be a second coarse, or lag the clock a little.
+		return !info.ModTime().Before(since.Truncate(time.Second))
+	}
+}
+
+// wait checks the probe every probeInterval until it succeeds, closing ready, or
+// until stop is closed. since is when the daemon started, see check.
+func (p *probe) wait(ready, stop chan struct{}, since time.Time) {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		if p.check(since) {
+			close(ready)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
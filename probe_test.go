@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProbe(t *testing.T) {
+	p, err := parseProbe("tcp://localhost:8080", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, &probe{spec: "tcp://localhost:8080", scheme: "tcp", target: "localhost:8080", status: 200}, p)
+
+	p, err = parseProbe("file:///tmp/app.sock", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp/app.sock", p.target)
+
+	for _, spec := range []string{"localhost:8080", "tcp://localhost", "udp://localhost:53", "file://"} {
+		_, err = parseProbe(spec, 0)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestProbeCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := parseProbe("tcp://"+l.Addr().String(), 0)
+	assert.True(t, p.check(time.Time{}))
+	l.Close()
+	assert.False(t, p.check(time.Time{}))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	p, _ = parseProbe(server.URL+"/health", 0)
+	assert.True(t, p.check(time.Time{}))
+	p, _ = parseProbe(server.URL+"/other", 0)
+	assert.False(t, p.check(time.Time{}))
+	p, _ = parseProbe(server.URL+"/other", http.StatusServiceUnavailable)
+	assert.True(t, p.check(time.Time{}))
+
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ready")
+	p, _ = parseProbe("file://"+path, 0)
+	start := time.Now()
+	assert.False(t, p.check(start))
+
+	// A file left by a previous run is not ready.
+	assert.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	old := start.Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(path, old, old))
+	assert.False(t, p.check(start))
+
+	// wait closes ready once the file is written again.
+	ready := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.wait(ready, stop, start)
+	assert.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("probe not ready")
+	}
+}
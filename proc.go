@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// procInfo is what Wago knows about a process from the process table.
+type procInfo struct {
+	pid  int
+	ppid int
+	pgid int
+	// start is the start time of the process, to tell apart reused pids.
+	start uint64
+	// zombie is set for processes that exited but have not been reaped.
+	zombie bool
+	comm   string
+}
+
+const (
+	// descendantInterval is how often the process tree of a command is scanned.
+	descendantInterval = 250 * time.Millisecond
+	// descendantWait is how long killed descendants have to disappear.
+	descendantWait = time.Second
+)
+
+// descendants tracks every process started by a command, including those that
+// moved to another process group or session and so don't receive the signals
+// sent to the process group of the command (Elixir, some daemons). A process
+// that has been seen once is tracked until it exits, even after its parent
+// exits and it is reparented.
+//
+// Processes are found by scanning the process table, see listProcs. Processes
+// that start and leave the tree between two scans are not found.
+type descendants struct {
+	root procInfo
+
+	mu   sync.Mutex
+	seen map[int]procInfo
+
+	stop chan struct{}
+}
+
+// trackDescendants starts tracking the descendants of the process pid.
+func trackDescendants(pid int) *descendants {
+	d := &descendants{
+		root: procInfo{pid: pid},
+		seen: make(map[int]procInfo),
+		stop: make(chan struct{}),
+	}
+
+	procs := listProcs()
+	if root, ok := procs[pid]; ok {
+		d.root = root
+	}
+	d.add(procs)
+
+	go func() {
+		ticker := time.NewTicker(descendantInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				d.add(listProcs())
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+
+	return d
+}
+
+// add adds the descendants of the root and of all processes seen before to
+// seen, and removes processes that have exited.
+func (d *descendants) add(procs map[int]procInfo) {
+	children := make(map[int][]int)
+	for _, p := range procs {
+		children[p.ppid] = append(children[p.ppid], p.pid)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var queue []int
+	// The pid of the root may be reused once it has exited.
+	if root, ok := procs[d.root.pid]; ok && root.start == d.root.start {
+		queue = append(queue, root.pid)
+	}
+	for pid, old := range d.seen {
+		if p, ok := procs[pid]; ok && p.start == old.start && !p.zombie {
+			queue = append(queue, pid)
+		} else {
+			delete(d.seen, pid)
+		}
+	}
+
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+
+		for _, child := range children[pid] {
+			if _, ok := d.seen[child]; ok || procs[child].zombie {
+				continue
+			}
+			d.seen[child] = procs[child]
+			queue = append(queue, child)
+		}
+	}
+}
+
+// alive returns the descendants that are still running.
+func (d *descendants) alive() []procInfo {
+	d.add(listProcs())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	procs := make([]procInfo, 0, len(d.seen))
+	for _, p := range d.seen {
+		procs = append(procs, p)
+	}
+	return procs
+}
+
+// signal sends sig to the running descendants outside the process group pgid,
+// which don't receive the signals sent to the group.
+func (d *descendants) signal(pgid int, sig syscall.Signal) {
+	for _, p := range d.alive() {
+		if p.pgid != pgid {
+			syscall.Kill(p.pid, sig)
+		}
+	}
+}
+
+// kill stops tracking and sends SIGKILL to the descendants that are still
+// running, then waits up to descendantWait for them to exit. It returns the
+// descendants that were killed.
+func (d *descendants) kill() []procInfo {
+	close(d.stop)
+
+	procs := d.alive()
+	for _, p := range procs {
+		syscall.Kill(p.pid, syscall.SIGKILL)
+	}
+
+	deadline := time.Now().Add(descendantWait)
+	for len(procs) > 0 && len(d.alive()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return procs
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// listProcs returns the processes in /proc by pid.
+func listProcs() map[int]procInfo {
+	procs := make(map[int]procInfo)
+
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		log.Debug("Error reading /proc:", err)
+		return procs
+	}
+
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+
+		// Processes are expected to exit between reading /proc and their stat.
+		data, err := ioutil.ReadFile("/proc/" + dir.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		p, err := parseStat(string(data))
+		if err != nil || p.pid != pid {
+			continue
+		}
+		procs[pid] = p
+	}
+
+	return procs
+}
+
+// parseStat parses /proc/[pid]/stat, see proc(5). The command name is in
+// parentheses and may itself contain spaces and parentheses.
+func parseStat(stat string) (procInfo, error) {
+	var p procInfo
+
+	open := strings.IndexByte(stat, '(')
+	end := strings.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return p, fmt.Errorf("malformed stat: %q", stat)
+	}
+
+	// Fields after the command name, starting with state (field 3).
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return p, fmt.Errorf("malformed stat: %q", stat)
+	}
+
+	var err error
+	if p.pid, err = strconv.Atoi(strings.TrimSpace(stat[:open])); err != nil {
+		return p, err
+	}
+	if p.ppid, err = strconv.Atoi(fields[1]); err != nil {
+		return p, err
+	}
+	if p.pgid, err = strconv.Atoi(fields[2]); err != nil {
+		return p, err
+	}
+	// starttime is field 22.
+	if p.start, err = strconv.ParseUint(fields[19], 10, 64); err != nil {
+		return p, err
+	}
+	p.comm = stat[open+1 : end]
+	p.zombie = fields[0] == "Z" || fields[0] == "X"
+
+	return p, nil
+}
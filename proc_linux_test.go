@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStat(t *testing.T) {
+	p, err := parseStat("4242 (my (odd) app) S 4200 4242 4242 0 -1 4194304 100 0 0 0 1 2 0 0 20 0 1 0 987654 1000 200")
+	assert.NoError(t, err)
+	assert.Equal(t, procInfo{pid: 4242, ppid: 4200, pgid: 4242, start: 987654, comm: "my (odd) app"}, p)
+
+	p, err = parseStat("4243 (sleep) Z 1 4242 4242 0 -1 4194304 100 0 0 0 1 2 0 0 20 0 1 0 987655 0 0")
+	assert.NoError(t, err)
+	assert.True(t, p.zombie)
+
+	_, err = parseStat("4242 sleep S 1")
+	assert.Error(t, err)
+}
+
+func TestDescendants(t *testing.T) {
+	pidFile, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidFile.Close()
+	defer os.Remove(pidFile.Name())
+
+	// The second sleep leaves the process group in a new session.
+	cmd := exec.Command("/bin/sh", "-c", "sleep 10 & setsid sh -c 'echo $$ > "+pidFile.Name()+"; exec sleep 10' & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	d := trackDescendants(cmd.Process.Pid)
+
+	var escaped int
+	for i := 0; i < 100 && escaped == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, _ := ioutil.ReadFile(pidFile.Name())
+		escaped, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	assert.NotZero(t, escaped)
+
+	// The group is killed, the escaped sleep is not.
+	d.add(listProcs())
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Wait()
+
+	killed := d.kill()
+	if assert.Len(t, killed, 1) {
+		assert.Equal(t, escaped, killed[0].pid)
+		assert.Equal(t, "sleep", killed[0].comm)
+	}
+
+	p, ok := listProcs()[escaped]
+	assert.True(t, !ok || p.zombie)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// listProcs returns no processes, descendants are only tracked on Linux. The
+// process group of a command still receives its signals.
+func listProcs() map[int]procInfo {
+	return map[int]procInfo{}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Project is a watch root with its own action chain. How events are matched
+// and ignore default to those of the config.
+type Project struct {
+	Name    string   `yaml:"name"`
+	Dir     string   `yaml:"dir"`
+	Watch   string   `yaml:"watch"`
+	Include globList `yaml:"include"`
+	Exclude globList `yaml:"exclude"`
+	Ops     string   `yaml:"ops"`
+	Ignore  string   `yaml:"ignore"`
+	GoDeps  string   `yaml:"go-deps"`
+	Steps   []*Step  `yaml:"steps"`
+}
+
+// projects returns a Config for each project. Without projects, cfg is the only
+// project.
+func (cfg *Config) projects() ([]*Config, error) {
+	// A debouncemax shorter than debounce would restart before events settle.
+	if cfg.Debounce > 0 && cfg.DebounceMax < cfg.Debounce {
+		return nil, fmt.Errorf("-debouncemax %v is shorter than -debounce %v", cfg.DebounceMax, cfg.Debounce)
+	}
+
+	if len(cfg.Projects) == 0 {
+		if _, err := newEventFilter(cfg); err != nil {
+			return nil, err
+		}
+		return []*Config{cfg}, nil
+	}
+
+	if len(cfg.Steps) > 0 || cfg.BuildCmd != "" || cfg.DaemonCmd != "" ||
+		cfg.PostCmd != "" || cfg.URL != "" {
+		return nil, fmt.Errorf("use either projects or an action chain, not both")
+	}
+
+	projects := make([]*Config, len(cfg.Projects))
+	names := make(map[string]struct{}, len(cfg.Projects))
+
+	for i, project := range cfg.Projects {
+		if project.Name == "" {
+			return nil, fmt.Errorf("project without a name (dir %q)", project.Dir)
+		}
+		if _, ok := names[project.Name]; ok {
+			return nil, fmt.Errorf("project %s: name is used more than once", project.Name)
+		}
+		names[project.Name] = struct{}{}
+
+		if project.Dir == "" {
+			return nil, fmt.Errorf("project %s: dir is required", project.Name)
+		}
+
+		p := *cfg
+		p.Projects = nil
+		p.Name = project.Name
+		p.TargetDir = project.Dir
+		p.Steps = project.Steps
+		p.GoDeps = project.GoDeps
+		if project.Watch != "" {
+			p.WatchRegex = project.Watch
+			p.Include, p.Exclude, p.Ops = nil, nil, ""
+		}
+		if len(project.Include) > 0 || len(project.Exclude) > 0 || project.Ops != "" {
+			p.Include = project.Include
+			p.Exclude = project.Exclude
+			p.Ops = project.Ops
+		}
+		if project.Ignore != "" {
+			p.IgnoreRegex = project.Ignore
+		}
+
+		if _, err := p.chainSteps(); err != nil {
+			return nil, fmt.Errorf("project %s: %v", project.Name, err)
+		}
+		if _, err := newEventFilter(&p); err != nil {
+			return nil, fmt.Errorf("project %s: %v", project.Name, err)
+		}
+
+		projects[i] = &p
+	}
+
+	return projects, nil
+}
+
+// inDir reports whether name is dir or is within it.
+func inDir(dir, name string) bool {
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// runProjects runs the action chain of each project, sharing watcher. Events are
+// passed to every project whose dir they are in, controls typed by the user to
+// every project.
+func runProjects(projects []*Config, watcher *Watcher, ctls <-chan control, quit chan struct{}) {
+	var wg sync.WaitGroup
+
+	// Events and controls are queued for each project, so that a project busy
+	// restarting does not hold up the others and none are dropped.
+	events := make([]chan<- fsnotify.Event, len(projects))
+	controls := make([]chan<- control, len(projects))
+	for i, project := range projects {
+		watcher := &Watcher{make(chan fsnotify.Event), make(chan error)}
+		events[i] = queueEvents(watcher.Event, quit)
+		ctls := make(chan control)
+		controls[i] = queueControls(ctls, quit)
+
+		wg.Add(1)
+		go func(project *Config) {
+			runChain(project, watcher, ctls, quit)
+			wg.Done()
+		}(project)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	for {
+		select {
+		case ev := <-watcher.Event:
+			for i, project := range projects {
+				// Go dependencies can be outside of the project dir.
+				if !inDir(project.TargetDir, ev.Name) &&
+					(project.deps == nil || !project.deps.match(ev.Name)) {
+					continue
+				}
+
+				select {
+				case events[i] <- ev:
+				case <-quit:
+				}
+			}
+		case ctl := <-ctls:
+			forwardControls(ctl, projects, controls, quit)
+		case err := <-watcher.Error:
+			log.Fatal("Watcher error:", err)(5)
+		case <-finished:
+			return
+		}
+	}
+}
+
+// queueEvents returns a channel whose events are queued and sent to out in order
+// until quit is closed. Sending to it never waits for the receiver of out. An
+// event that is already queued is not queued again, so a project that is busy
+// for long queues each change of a file once.
+func queueEvents(out chan<- fsnotify.Event, quit chan struct{}) chan<- fsnotify.Event {
+	in := make(chan fsnotify.Event)
+
+	go func() {
+		var queue []fsnotify.Event
+		queued := make(map[fsnotify.Event]bool)
+		for {
+			// Sending to a nil channel blocks, so only a queued event is sent.
+			var send chan<- fsnotify.Event
+			var next fsnotify.Event
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+
+			select {
+			case ev := <-in:
+				if !queued[ev] {
+					queued[ev] = true
+					queue = append(queue, ev)
+				}
+			case send <- next:
+				delete(queued, next)
+				queue = queue[1:]
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return in
+}
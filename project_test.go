@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueEvents(t *testing.T) {
+	out := make(chan fsnotify.Event)
+	quit := make(chan struct{})
+	defer close(quit)
+	in := queueEvents(out, quit)
+
+	write := fsnotify.Event{Name: "main.go", Op: fsnotify.Write}
+	create := fsnotify.Event{Name: "main.css", Op: fsnotify.Create}
+
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			in <- write
+		}
+		in <- create
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Sending an event waited for the receiver")
+	}
+
+	// The same event queued again is sent once.
+	assert.Equal(t, write, <-out)
+	assert.Equal(t, create, <-out)
+	select {
+	case ev := <-out:
+		t.Error("Unexpected event:", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once sent, an event is queued again.
+	in <- write
+	assert.Equal(t, write, <-out)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/creack/pty"
+)
+
+// ptys are the masters of the pseudo-terminals of running processes, resized
+// along with the terminal of Wago.
+var ptys = struct {
+	sync.Mutex
+	files map[*os.File]struct{}
+	once  sync.Once
+}{files: make(map[*os.File]struct{})}
+
+// attachPTY attaches the process to a new pseudo-terminal instead of pipes, so
+// that it detects a terminal and keeps colors, progress bars and line editing.
+// Its output, stdout and stderr together, is read from cmd.Stdout.
+//
+// The process is a session leader with the pseudo-terminal as its controlling
+// terminal. The session is also a new process group, so it is stopped as usual.
+func (cmd *Cmd) attachPTY() {
+	var err error
+	cmd.pty, cmd.tty, err = pty.Open()
+	if err != nil {
+		cmd.log.Fatal("Error making pseudo-terminal (step, error):", cmd.Name, err)(9)
+	}
+
+	// The terminal of Wago may not be a terminal, then the default size is kept.
+	pty.InheritSize(os.Stdin, cmd.pty)
+
+	cmd.Cmd.Stdin = cmd.tty
+	cmd.Cmd.Stdout = cmd.tty
+	cmd.Cmd.Stderr = cmd.tty
+
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+
+	cmd.Stdin = cmd.pty
+	cmd.Stdout = ptyReader{cmd.pty}
+	cmd.Stderr = ioutil.NopCloser(bytes.NewReader(nil))
+
+	ptys.once.Do(resizePTYs)
+	ptys.Lock()
+	ptys.files[cmd.pty] = struct{}{}
+	ptys.Unlock()
+}
+
+// closePTY closes the master of a pseudo-terminal once its process has exited.
+func closePTY(f *os.File) {
+	ptys.Lock()
+	delete(ptys.files, f)
+	ptys.Unlock()
+
+	f.Close()
+}
+
+// resizePTYs resizes all pseudo-terminals to the size of the terminal of Wago
+// whenever it changes.
+func resizePTYs() {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+
+	go func() {
+		for range winch {
+			ptys.Lock()
+			for f := range ptys.files {
+				if err := pty.InheritSize(os.Stdin, f); err != nil {
+					log.Debug("Error resizing pseudo-terminal:", err)
+				}
+			}
+			ptys.Unlock()
+		}
+	}()
+}
+
+// ptyReader reads the output of a process from the master of its
+// pseudo-terminal. Once all processes have closed the terminal, Linux returns
+// EIO instead of EOF. The file is not embedded, io.Copy would use its WriteTo.
+type ptyReader struct {
+	f *os.File
+}
+
+func (r ptyReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.EIO {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r ptyReader) Close() error {
+	return r.f.Close()
+}
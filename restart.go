@@ -0,0 +1,75 @@
+package main
+
+import "time"
+
+// RestartPolicy decides whether a daemon that exits on its own is restarted.
+type RestartPolicy string
+
+// Restart policies. Daemons are never restarted by default.
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+const (
+	// defaultBackoff is the delay before the first restart of a daemon.
+	defaultBackoff = 500 * time.Millisecond
+	// maxBackoff is the longest delay between restarts. A daemon that ran for at
+	// least this long was not crash looping, its restarts and delay are reset.
+	maxBackoff = 30 * time.Second
+)
+
+// valid reports whether p is a known policy.
+func (p RestartPolicy) valid() bool {
+	switch p {
+	case RestartNever, RestartOnFailure, RestartAlways:
+		return true
+	}
+	return false
+}
+
+// restarts reports whether a daemon that exited, with failure or not, is
+// restarted.
+func (p RestartPolicy) restarts(failed bool) bool {
+	return p == RestartAlways || (p == RestartOnFailure && failed)
+}
+
+// backoff tracks the restarts of a daemon since it was last started by Wago.
+type backoff struct {
+	max   int
+	first time.Duration
+	delay time.Duration
+	count int
+}
+
+// newBackoff constructs a backoff allowing max consecutive restarts, negative
+// is unlimited, starting with a delay of first.
+func newBackoff(max int, first time.Duration) *backoff {
+	if first <= 0 {
+		first = defaultBackoff
+	}
+	return &backoff{max: max, first: first, delay: first}
+}
+
+// next returns the delay before the next restart of a daemon that ran for
+// uptime, or false if the budget of restarts is spent.
+func (b *backoff) next(uptime time.Duration) (time.Duration, bool) {
+	if uptime >= maxBackoff {
+		b.count = 0
+		b.delay = b.first
+	}
+
+	if b.max >= 0 && b.count >= b.max {
+		return 0, false
+	}
+	b.count++
+
+	delay := b.delay
+	b.delay *= 2
+	if b.delay > maxBackoff {
+		b.delay = maxBackoff
+	}
+
+	return delay, true
+}
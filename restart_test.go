@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestartPolicy(t *testing.T) {
+	assert.False(t, RestartNever.restarts(true))
+	assert.True(t, RestartOnFailure.restarts(true))
+	assert.False(t, RestartOnFailure.restarts(false))
+	assert.True(t, RestartAlways.restarts(false))
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(3, time.Second)
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		delay, ok := b.next(0)
+		assert.True(t, ok)
+		assert.Equal(t, want, delay)
+	}
+	_, ok := b.next(0)
+	assert.False(t, ok)
+
+	// A daemon that ran for a while was not crash looping.
+	delay, ok := b.next(maxBackoff)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, delay)
+
+	b = newBackoff(-1, 20*time.Second)
+	for i := 0; i < 10; i++ {
+		delay, ok = b.next(0)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, maxBackoff, delay)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// changedFilesLimit is the largest WAGO_CHANGED_FILES passed in the environment,
+// longer lists are only available from WAGO_CHANGED_FILES_LIST.
+const changedFilesLimit = 32 * 1024
+
+// Run describes one start of the steps of a project and the file system events
+// that caused it, which are passed to commands in environment variables.
+type Run struct {
+	// ID counts the runs of a project, the first run is 1.
+	ID int
+	// Events are the matched events coalesced into this run, none for the first.
+	Events []fsnotify.Event
+
+	// listFile is a temp file listing the changed files, one per line.
+	listFile string
+
+	// mu guards steps, the steps of the run still running, and closed. The list
+	// file is removed once the run is closed and no step is running.
+	mu     sync.Mutex
+	steps  int
+	closed bool
+}
+
+// newRun constructs the Run with id for events and writes its list of changed
+// files. Errors are logged, commands then get no list file.
+func newRun(log prefixLog, id int, events []fsnotify.Event) *Run {
+	run := &Run{ID: id, Events: events}
+
+	f, err := ioutil.TempFile("", "wago-changed-")
+	if err != nil {
+		log.Err("Error creating changed files list:", err)
+		return run
+	}
+	defer f.Close()
+
+	for _, name := range run.files() {
+		fmt.Fprintln(f, name)
+	}
+	run.listFile = f.Name()
+
+	return run
+}
+
+// files returns the names of the changed files without duplicates, in the order
+// of their first event.
+func (run *Run) files() []string {
+	var files []string
+	seen := make(map[string]bool)
+
+	for _, ev := range run.Events {
+		if !seen[ev.Name] {
+			seen[ev.Name] = true
+			files = append(files, ev.Name)
+		}
+	}
+
+	return files
+}
+
+// ops returns the names of the types of the events, comma separated.
+func (run *Run) ops() string {
+	var op fsnotify.Op
+	for _, ev := range run.Events {
+		op |= ev.Op
+	}
+
+	var names []string
+	for _, name := range []string{"create", "write", "remove", "rename", "chmod"} {
+		if op&eventOps[name] != 0 {
+			names = append(names, name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// env returns the environment variables describing the run to the command of
+// step.
+func (run *Run) env(step string) []string {
+	files := strings.Join(run.files(), "\n")
+	if len(files) > changedFilesLimit {
+		files = ""
+	}
+
+	return []string{
+		"WAGO_CHANGED_FILES=" + files,
+		"WAGO_CHANGED_FILES_LIST=" + run.listFile,
+		"WAGO_EVENT_OPS=" + run.ops(),
+		fmt.Sprint("WAGO_RUN_ID=", run.ID),
+		"WAGO_STEP=" + step,
+	}
+}
+
+// acquire counts a step started for the run, which may read its list file
+// until release.
+func (run *Run) acquire() {
+	run.mu.Lock()
+	run.steps++
+	run.mu.Unlock()
+}
+
+// release counts a step of the run that is no longer running.
+func (run *Run) release() {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.steps--
+	run.remove()
+}
+
+// close removes the list of changed files once no step of the run is running.
+func (run *Run) close() {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.closed = true
+	run.remove()
+}
+
+// remove removes the list file of a closed run without running steps. run.mu
+// must be held.
+func (run *Run) remove() {
+	if run.closed && run.steps == 0 && run.listFile != "" {
+		os.Remove(run.listFile)
+	}
+}
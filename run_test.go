@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunEnv(t *testing.T) {
+	run := newRun(prefixLog(""), 2, []fsnotify.Event{
+		{Name: "/src/main.go", Op: fsnotify.Write},
+		{Name: "/src/web/main.css", Op: fsnotify.Create},
+		{Name: "/src/main.go", Op: fsnotify.Write | fsnotify.Chmod},
+	})
+	defer run.close()
+
+	assert.Equal(t, []string{
+		"WAGO_CHANGED_FILES=/src/main.go\n/src/web/main.css",
+		"WAGO_CHANGED_FILES_LIST=" + run.listFile,
+		"WAGO_EVENT_OPS=create,write,chmod",
+		"WAGO_RUN_ID=2",
+		"WAGO_STEP=build",
+	}, run.env("build"))
+
+	list, err := ioutil.ReadFile(run.listFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "/src/main.go\n/src/web/main.css\n", string(list))
+
+	run.close()
+	_, err = os.Stat(run.listFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// The list file of a run is kept until none of its steps is running.
+func TestRunClose(t *testing.T) {
+	run := newRun(prefixLog(""), 2, []fsnotify.Event{{Name: "/src/main.go", Op: fsnotify.Write}})
+	run.acquire()
+	run.acquire()
+
+	run.release()
+	run.close()
+	_, err := os.Stat(run.listFile)
+	assert.NoError(t, err)
+
+	run.release()
+	_, err = os.Stat(run.listFile)
+	assert.True(t, os.IsNotExist(err))
+}
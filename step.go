@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// StepKind selects which Runnable a Step is run with.
+type StepKind string
+
+// Step kinds, named after the Runnable they construct.
+const (
+	KindRunWait       StepKind = "RunWait"
+	KindDaemonTimer   StepKind = "DaemonTimer"
+	KindDaemonTrigger StepKind = "DaemonTrigger"
+	KindDaemonReady   StepKind = "DaemonReady"
+	KindBrowser       StepKind = "Browser"
+)
+
+// Step is one named action in the action chain.
+type Step struct {
+	Name    string   `yaml:"name"`
+	Kind    StepKind `yaml:"kind"`
+	Command string   `yaml:"command"`
+
+	// Timeout fails a RunWait that has not exited within it, defaults to
+	// -timeout. StartTimeout fails a DaemonTrigger that has not output its trigger
+	// within it, defaults to -starttimeout. Both are killed, 0 waits forever.
+	Timeout      time.Duration `yaml:"timeout"`
+	StartTimeout time.Duration `yaml:"start_timeout"`
+
+	// Timer is milliseconds to wait for a DaemonTimer.
+	Timer int `yaml:"timer"`
+	// Trigger is a regex matching the line of output a DaemonTrigger waits for.
+	// If a line matches FailTrigger first, the step fails.
+	Trigger     string `yaml:"trigger"`
+	FailTrigger string `yaml:"fail_trigger"`
+	// Ready is the probe a DaemonReady waits for, see probe. ReadyStatus is the
+	// HTTP status expected by http probes, defaults to 200. If the probe does not
+	// succeed within ReadyTimeout, defaults to -readytimeout, the step fails. 0
+	// waits forever, so ReadyTimeout is nil if it is not set rather than 0.
+	Ready        string         `yaml:"ready"`
+	ReadyStatus  int            `yaml:"ready_status"`
+	ReadyTimeout *time.Duration `yaml:"ready_timeout"`
+	// URL is opened by a Browser.
+	URL string `yaml:"url"`
+
+	// DependsOn names the steps that must be done before this step starts. If no
+	// step in the chain declares it, steps run one after another in order.
+	DependsOn []string `yaml:"depends_on"`
+
+	// Watch and WatchRegex limit which file changes restart the step, by glob or
+	// regex of the path relative to -dir. Without either, any change that matches
+	// -watch does. Steps that depend on a restarted step are restarted too.
+	Watch      []string `yaml:"watch"`
+	WatchRegex string   `yaml:"watch_regex"`
+
+	// Restart is the policy for a daemon that exits on its own, defaults to
+	// -restart. MaxRestarts limits consecutive restarts, defaults to -maxrestarts,
+	// negative is unlimited. Backoff is the delay before the first restart,
+	// doubled for each consecutive restart.
+	Restart     RestartPolicy `yaml:"restart"`
+	MaxRestarts int           `yaml:"max_restarts"`
+	Backoff     time.Duration `yaml:"backoff"`
+
+	// StopSignal is sent to stop the step, defaults to -stopsignal. If it has not
+	// exited after StopGrace, defaults to -exitwait, it is sent SIGKILL.
+	// StopSequence replaces both with stages of signals and waits, like
+	// "INT 2s TERM 5s KILL". StopCommand, like "docker compose stop", is run
+	// instead of sending StopSignal.
+	StopSignal   string        `yaml:"stop_signal"`
+	StopGrace    time.Duration `yaml:"stop_grace"`
+	StopSequence string        `yaml:"stop_sequence"`
+	StopCommand  string        `yaml:"stop_command"`
+
+	// PTY runs the command attached to a pseudo-terminal instead of pipes, for
+	// tools that only use colors or line editing in a terminal. Defaults to -pty.
+	PTY bool `yaml:"pty"`
+	// Prefix prefixes each line of output with the name of the step, colored in
+	// a terminal, to tell apart the output of concurrent steps. Defaults to
+	// -prefix.
+	Prefix bool `yaml:"prefix"`
+
+	// MemoryMax, CPUMax and PidsMax limit the processes of the step when -cgroup
+	// is set, defaulting to -memorymax, -cpumax and -pidsmax. MemoryMax is bytes
+	// with an optional K, M, G or T suffix, CPUMax a number of CPUs.
+	MemoryMax string  `yaml:"memory_max"`
+	CPUMax    float64 `yaml:"cpu_max"`
+	PidsMax   int     `yaml:"pids_max"`
+}
+
+// daemon reports whether the step runs a daemon.
+func (step *Step) daemon() bool {
+	return step.Kind == KindDaemonTimer || step.Kind == KindDaemonTrigger || step.Kind == KindDaemonReady
+}
+
+// defaults sets the timeouts of steps and the restart policy of daemons from
+// cfg unless the step has its own.
+func (step *Step) defaults(cfg *Config) {
+	if step.Kind == KindRunWait && step.Timeout == 0 {
+		step.Timeout = cfg.Timeout
+	}
+	if step.Kind == KindDaemonTrigger && step.StartTimeout == 0 {
+		step.StartTimeout = cfg.StartTimeout
+	}
+
+	if step.Kind != KindBrowser {
+		if cfg.PTY {
+			step.PTY = true
+		}
+		if cfg.Prefix {
+			step.Prefix = true
+		}
+		if step.MemoryMax == "" {
+			step.MemoryMax = cfg.MemoryMax
+		}
+		if step.CPUMax == 0 {
+			step.CPUMax = cfg.CPUMax
+		}
+		if step.PidsMax == 0 {
+			step.PidsMax = cfg.PidsMax
+		}
+	}
+
+	if !step.daemon() {
+		return
+	}
+	if step.Kind == KindDaemonReady && step.ReadyTimeout == nil {
+		timeout := cfg.ReadyTimeout
+		step.ReadyTimeout = &timeout
+	}
+	if step.Restart == "" {
+		step.Restart = RestartPolicy(cfg.Restart)
+	}
+	if step.MaxRestarts == 0 {
+		step.MaxRestarts = cfg.MaxRestarts
+	}
+}
+
+// Runnable constructs the Runnable for the step.
+func (step *Step) Runnable(cfg *Config) Runnable {
+	// The stop signals have been validated by chainSteps.
+	stop, _ := step.stopSpec(cfg)
+	opts := cmdOptions{stop: stop, limits: step.cgroupLimits(), pty: step.PTY, prefix: step.Prefix}
+
+	switch step.Kind {
+	case KindDaemonTimer:
+		return NewDaemonTimer(cfg, step.Name, step.Command, opts, step.Timer)
+	case KindDaemonTrigger:
+		// The regexes have been validated by chainSteps.
+		trigger := regexp.MustCompile(step.Trigger)
+		var failTrigger *regexp.Regexp
+		if step.FailTrigger != "" {
+			failTrigger = regexp.MustCompile(step.FailTrigger)
+		}
+		return NewDaemonTrigger(cfg, step.Name, step.Command, opts, trigger, failTrigger, step.StartTimeout)
+	case KindDaemonReady:
+		// The probe has been validated by chainSteps.
+		ready, _ := parseProbe(step.Ready, step.ReadyStatus)
+		// The timeout has been set by defaults.
+		return NewDaemonReady(cfg, step.Name, step.Command, opts, ready, *step.ReadyTimeout)
+	case KindBrowser:
+		return NewBrowser(step.URL)
+	default:
+		return NewRunWait(cfg, step.Name, step.Command, opts, step.Timeout)
+	}
+}
+
+// validate checks that a step has everything its kind requires.
+func (step *Step) validate(cfg *Config) error {
+	if step.Name == "" {
+		return fmt.Errorf("step without a name (command %q)", step.Command)
+	}
+
+	switch step.Kind {
+	case KindRunWait, KindDaemonTimer, KindDaemonTrigger, KindDaemonReady:
+		if step.Command == "" {
+			return fmt.Errorf("step %s: command is required", step.Name)
+		}
+	case KindBrowser:
+		if step.URL == "" {
+			return fmt.Errorf("step %s: url is required", step.Name)
+		}
+	default:
+		return fmt.Errorf("step %s: unknown kind %q", step.Name, step.Kind)
+	}
+
+	if step.Kind == KindDaemonTrigger && step.Trigger == "" {
+		return fmt.Errorf("step %s: trigger is required", step.Name)
+	}
+	if (step.Trigger != "" || step.FailTrigger != "") && step.Kind != KindDaemonTrigger {
+		return fmt.Errorf("step %s: trigger is only used by %s", step.Name, KindDaemonTrigger)
+	}
+	for _, re := range []string{step.Trigger, step.FailTrigger} {
+		if _, err := regexp.Compile(re); err != nil {
+			return fmt.Errorf("step %s: trigger: %v", step.Name, err)
+		}
+	}
+	if step.Kind == KindDaemonReady {
+		if step.Ready == "" {
+			return fmt.Errorf("step %s: ready is required", step.Name)
+		}
+		if _, err := parseProbe(step.Ready, step.ReadyStatus); err != nil {
+			return fmt.Errorf("step %s: %v", step.Name, err)
+		}
+	}
+	if (step.Ready != "" || step.ReadyStatus != 0 || step.ReadyTimeout != nil) && step.Kind != KindDaemonReady {
+		return fmt.Errorf("step %s: ready is only used by %s", step.Name, KindDaemonReady)
+	}
+	if step.Timeout != 0 && step.Kind != KindRunWait {
+		return fmt.Errorf("step %s: timeout is only used by %s", step.Name, KindRunWait)
+	}
+	if step.StartTimeout != 0 && step.Kind != KindDaemonTrigger {
+		return fmt.Errorf("step %s: start_timeout is only used by %s", step.Name, KindDaemonTrigger)
+	}
+	if step.Timer != 0 && step.Kind != KindDaemonTimer {
+		return fmt.Errorf("step %s: timer is only used by %s", step.Name, KindDaemonTimer)
+	}
+
+	if step.Restart != "" && !step.Restart.valid() {
+		return fmt.Errorf("step %s: unknown restart policy %q", step.Name, step.Restart)
+	}
+	if (step.Restart != "" || step.MaxRestarts != 0 || step.Backoff != 0) && !step.daemon() {
+		return fmt.Errorf("step %s: restart is only used by daemons", step.Name)
+	}
+
+	if (step.StopSignal != "" || step.StopGrace != 0 || step.StopSequence != "" || step.StopCommand != "") &&
+		step.Kind == KindBrowser {
+		return fmt.Errorf("step %s: stop is not used by %s", step.Name, KindBrowser)
+	}
+	if step.Kind != KindBrowser {
+		if _, err := step.stopSpec(cfg); err != nil {
+			return fmt.Errorf("step %s: %v", step.Name, err)
+		}
+	}
+
+	if (step.PTY || step.Prefix) && step.Kind == KindBrowser {
+		return fmt.Errorf("step %s: pty and prefix are not used by %s", step.Name, KindBrowser)
+	}
+
+	if step.MemoryMax != "" || step.CPUMax != 0 || step.PidsMax != 0 {
+		if step.Kind == KindBrowser {
+			return fmt.Errorf("step %s: limits are not used by %s", step.Name, KindBrowser)
+		}
+		if cfg.Cgroup == "" {
+			return fmt.Errorf("step %s: memory_max, cpu_max and pids_max require -cgroup", step.Name)
+		}
+	}
+	if step.MemoryMax != "" {
+		if _, err := parseMemory(step.MemoryMax); err != nil {
+			return fmt.Errorf("step %s: memory_max: %v", step.Name, err)
+		}
+	}
+	if step.CPUMax < 0 || step.PidsMax < 0 {
+		return fmt.Errorf("step %s: cpu_max and pids_max can't be negative", step.Name)
+	}
+
+	if _, err := newScope(step.Watch, step.WatchRegex); err != nil {
+		return fmt.Errorf("step %s: watch: %v", step.Name, err)
+	}
+
+	return nil
+}
+
+// chainSteps returns the steps of the action chain. These are either the steps
+// of the config file or those built from -cmd, -daemon, -pcmd and -url, which
+// are named after their flag.
+func (cfg *Config) chainSteps() ([]*Step, error) {
+	legacy := make([]*Step, 0, 4)
+
+	if cfg.BuildCmd != "" {
+		legacy = append(legacy, &Step{Name: "cmd", Kind: KindRunWait, Command: cfg.BuildCmd})
+	}
+	if cfg.DaemonCmd != "" {
+		if cfg.DaemonTrigger != "" {
+			legacy = append(legacy, &Step{Name: "daemon", Kind: KindDaemonTrigger,
+				Command: cfg.DaemonCmd, Trigger: cfg.DaemonTrigger, FailTrigger: cfg.FailTrigger})
+		} else if cfg.DaemonReady != "" {
+			legacy = append(legacy, &Step{Name: "daemon", Kind: KindDaemonReady,
+				Command: cfg.DaemonCmd, Ready: cfg.DaemonReady})
+		} else {
+			legacy = append(legacy, &Step{Name: "daemon", Kind: KindDaemonTimer,
+				Command: cfg.DaemonCmd, Timer: cfg.DaemonTimer})
+		}
+	}
+	if cfg.PostCmd != "" {
+		legacy = append(legacy, &Step{Name: "pcmd", Kind: KindRunWait, Command: cfg.PostCmd})
+	}
+	if cfg.URL != "" {
+		legacy = append(legacy, &Step{Name: "url", Kind: KindBrowser, URL: cfg.URL})
+	}
+
+	if len(cfg.Steps) == 0 {
+		for _, step := range legacy {
+			step.defaults(cfg)
+			if err := step.validate(cfg); err != nil {
+				return nil, err
+			}
+		}
+		return legacy, nil
+	}
+	if len(legacy) > 0 {
+		return nil, fmt.Errorf("use either steps or -cmd, -daemon, -pcmd and -url, not both")
+	}
+
+	names := make(map[string]struct{}, len(cfg.Steps))
+	for _, step := range cfg.Steps {
+		if step.Kind == "" {
+			step.Kind = KindRunWait
+		}
+		step.defaults(cfg)
+		if err := step.validate(cfg); err != nil {
+			return nil, err
+		}
+		if _, ok := names[step.Name]; ok {
+			return nil, fmt.Errorf("step %s: name is used more than once", step.Name)
+		}
+		names[step.Name] = struct{}{}
+	}
+
+	if _, err := stepDeps(cfg.Steps); err != nil {
+		return nil, err
+	}
+
+	return cfg.Steps, nil
+}
+
+// stepDeps returns, for each step, the indexes of the steps it depends on.
+// Without any depends_on, each step depends on the one before it. An error is
+// returned for unknown step names and dependency cycles.
+func stepDeps(steps []*Step) ([][]int, error) {
+	deps := make([][]int, len(steps))
+
+	graph := false
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		index[step.Name] = i
+		if len(step.DependsOn) > 0 {
+			graph = true
+		}
+	}
+
+	if !graph {
+		for i := 1; i < len(steps); i++ {
+			deps[i] = []int{i - 1}
+		}
+		return deps, nil
+	}
+
+	for i, step := range steps {
+		for _, name := range step.DependsOn {
+			d, ok := index[name]
+			if !ok {
+				return nil, fmt.Errorf("step %s: depends on unknown step %s", step.Name, name)
+			}
+			deps[i] = append(deps[i], d)
+		}
+	}
+
+	// Depth first search for cycles. A step that is reached again while it is
+	// still being visited is part of a cycle.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(steps))
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("step %s: dependency cycle", steps[i].Name)
+		case visited:
+			return nil
+		}
+
+		state[i] = visiting
+		for _, d := range deps[i] {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+
+		return nil
+	}
+
+	for i := range steps {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return deps, nil
+}
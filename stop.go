@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// signals are the signals a step can be stopped with, by name without SIG.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// parseSignal parses a signal name like INT or SIGINT.
+func parseSignal(name string) (string, syscall.Signal, error) {
+	name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+	sig, ok := signals[name]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return "SIG" + name, sig, nil
+}
+
+// stopStage sends a signal to the process group of a step and gives it wait to
+// exit before the next stage.
+type stopStage struct {
+	name   string
+	signal syscall.Signal
+	wait   time.Duration
+}
+
+// stopSpec is how the processes of a step are stopped: the stages of signals,
+// ending with SIGKILL, and an optional command run instead of the signals before
+// SIGKILL.
+type stopSpec struct {
+	stages  []stopStage
+	command string
+	shell   string
+}
+
+// parseStopSequence parses an escalation sequence of signals and the time to
+// wait after each, like "INT 2s TERM 5s KILL". Arrows and commas may separate
+// the parts: "INT → 2s → TERM". A signal without a wait is followed by the next
+// right away. If the sequence does not end with KILL, SIGKILL is
+// sent after waiting grace.
+func parseStopSequence(seq string, grace time.Duration) ([]stopStage, error) {
+	for _, sep := range []string{"→", "->", ","} {
+		seq = strings.Replace(seq, sep, " ", -1)
+	}
+
+	var stages []stopStage
+	for _, field := range strings.Fields(seq) {
+		// A duration is the wait after the signal before it.
+		if wait, err := time.ParseDuration(field); err == nil {
+			if len(stages) == 0 || stages[len(stages)-1].wait != 0 {
+				return nil, fmt.Errorf("stop sequence: %s does not follow a signal", field)
+			}
+			stages[len(stages)-1].wait = wait
+			continue
+		}
+
+		name, sig, err := parseSignal(field)
+		if err != nil {
+			return nil, fmt.Errorf("stop sequence: %v", err)
+		}
+		stages = append(stages, stopStage{name: name, signal: sig})
+	}
+
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("stop sequence is empty")
+	}
+
+	if last := &stages[len(stages)-1]; last.signal != syscall.SIGKILL {
+		if last.wait == 0 {
+			last.wait = grace
+		}
+		stages = append(stages, stopStage{name: "SIGKILL", signal: syscall.SIGKILL})
+	}
+
+	return stages, nil
+}
+
+// stopSpec returns how the processes of the step are stopped. By default they
+// are sent the stop signal, SIGTERM unless set, and SIGKILL if they have not
+// exited after the grace period, -exitwait unless set.
+func (step *Step) stopSpec(cfg *Config) (*stopSpec, error) {
+	spec := &stopSpec{command: step.StopCommand, shell: cfg.Shell}
+
+	grace := time.Duration(cfg.ExitWait) * time.Millisecond
+	if step.StopGrace > 0 {
+		grace = step.StopGrace
+	}
+
+	if step.StopSequence != "" {
+		if step.StopSignal != "" || step.StopGrace != 0 {
+			return nil, fmt.Errorf("use either stop_sequence or stop_signal and stop_grace, not both")
+		}
+		if step.StopCommand != "" {
+			return nil, fmt.Errorf("use either stop_sequence or stop_command, not both")
+		}
+
+		var err error
+		spec.stages, err = parseStopSequence(step.StopSequence, grace)
+		return spec, err
+	}
+
+	signal := cfg.StopSignal
+	if step.StopSignal != "" {
+		signal = step.StopSignal
+	}
+
+	name, sig, err := parseSignal(signal)
+	if err != nil {
+		return nil, err
+	}
+
+	spec.stages = []stopStage{
+		{name: name, signal: sig, wait: grace},
+		{name: "SIGKILL", signal: syscall.SIGKILL},
+	}
+	return spec, nil
+}
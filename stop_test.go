@@ -0,0 +1,78 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSignal(t *testing.T) {
+	name, sig, err := parseSignal("int")
+	assert.NoError(t, err)
+	assert.Equal(t, "SIGINT", name)
+	assert.Equal(t, syscall.SIGINT, sig)
+
+	name, sig, err = parseSignal("SIGQUIT")
+	assert.NoError(t, err)
+	assert.Equal(t, "SIGQUIT", name)
+	assert.Equal(t, syscall.SIGQUIT, sig)
+
+	_, _, err = parseSignal("STOP")
+	assert.Error(t, err)
+}
+
+func TestParseStopSequence(t *testing.T) {
+	stages, err := parseStopSequence("INT → 2s → TERM → 5s → KILL", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []stopStage{
+		{"SIGINT", syscall.SIGINT, 2 * time.Second},
+		{"SIGTERM", syscall.SIGTERM, 5 * time.Second},
+		{"SIGKILL", syscall.SIGKILL, 0},
+	}, stages)
+
+	// SIGKILL follows after the grace period.
+	stages, err = parseStopSequence("QUIT, TERM 3s", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []stopStage{
+		{"SIGQUIT", syscall.SIGQUIT, 0},
+		{"SIGTERM", syscall.SIGTERM, 3 * time.Second},
+		{"SIGKILL", syscall.SIGKILL, 0},
+	}, stages)
+
+	stages, err = parseStopSequence("INT", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, stages[0].wait)
+	assert.Len(t, stages, 2)
+
+	for _, seq := range []string{"", "INT -> soon", "INT 2s STOP", "2s"} {
+		_, err = parseStopSequence(seq, time.Second)
+		assert.Error(t, err, seq)
+	}
+}
+
+func TestStopSpec(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Shell = "/bin/sh"
+
+	spec, err := (&Step{}).stopSpec(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []stopStage{
+		{"SIGTERM", syscall.SIGTERM, 50 * time.Millisecond},
+		{"SIGKILL", syscall.SIGKILL, 0},
+	}, spec.stages)
+
+	spec, err = (&Step{StopSignal: "INT", StopGrace: time.Second, StopCommand: "make stop"}).stopSpec(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, stopStage{"SIGINT", syscall.SIGINT, time.Second}, spec.stages[0])
+	assert.Equal(t, "make stop", spec.command)
+	assert.Equal(t, "/bin/sh", spec.shell)
+
+	spec, err = (&Step{StopSequence: "QUIT 1s KILL"}).stopSpec(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, spec.stages, 2)
+
+	_, err = (&Step{StopSequence: "QUIT", StopGrace: time.Second}).stopSpec(cfg)
+	assert.Error(t, err)
+}
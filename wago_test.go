@@ -1,11 +1,14 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
 )
 
 func NewFakeWatcher() *Watcher {
@@ -24,19 +27,38 @@ func TestAppIntegrations(t *testing.T) {
 		t.Skip("Skipping application integration testing.")
 	}
 
-	// essential setup commands
-	*shell = "/bin/sh"
-
-	subStdin, unsubStdin = ManageUserInput(os.Stdin)
+	subStdin, unsubStdin = ManageUserInput(os.Stdin, nil)
 
 	t.Run("Simple", appSimple)
 	t.Run("EventRace", appEventRace)
 	t.Run("Daemon", appDaemon)
 	t.Run("DaemonTimer", appDaemonTimer)
+	t.Run("Graph", appGraph)
+	t.Run("Scope", appScope)
+	t.Run("Projects", appProjects)
+	t.Run("Debounce", appDebounce)
+	t.Run("Env", appEnv)
+	t.Run("EnvBurst", appEnvBurst)
+	t.Run("Restart", appRestart)
+	t.Run("Ready", appReady)
+	t.Run("ReadyNoTimeout", appReadyNoTimeout)
+	t.Run("FailTrigger", appFailTrigger)
+	t.Run("Timeout", appTimeout)
+	t.Run("Stop", appStop)
+	t.Run("PTY", appPTY)
+	t.Run("Control", appControl)
+}
+
+// testConfig returns the default config with a predictable shell.
+func testConfig() *Config {
+	cfg := defaultConfig()
+	cfg.Shell = "/bin/sh"
+	return cfg
 }
 
 func appSimple(t *testing.T) {
-	*buildCmd = "echo testsimple"
+	cfg := testConfig()
+	cfg.BuildCmd = "echo testsimple"
 
 	watcher := NewFakeWatcher()
 
@@ -62,12 +84,12 @@ func appSimple(t *testing.T) {
 		close(quit)
 	}()
 
-	runChain(watcher, quit)
-	*buildCmd = ""
+	runChain(cfg, watcher, nil, quit)
 }
 
 func appEventRace(t *testing.T) {
-	*buildCmd = "echo echonow"
+	cfg := testConfig()
+	cfg.BuildCmd = "echo echonow"
 
 	watcher := NewFakeWatcher()
 
@@ -93,12 +115,12 @@ func appEventRace(t *testing.T) {
 		close(quit)
 	}()
 
-	runChain(watcher, quit)
-	*buildCmd = ""
+	runChain(cfg, watcher, nil, quit)
 }
 
 func appDaemon(t *testing.T) {
-	*daemonCmd = "sleep 1s && echo testdaemonOut1 && sleep 2s && echo testdaemonOut2"
+	cfg := testConfig()
+	cfg.DaemonCmd = "sleep 1s && echo testdaemonOut1 && sleep 2s && echo testdaemonOut2"
 	watcher := NewFakeWatcher()
 
 	quit := make(chan struct{})
@@ -111,13 +133,13 @@ func appDaemon(t *testing.T) {
 		close(quit)
 	}()
 
-	runChain(watcher, quit)
-	*daemonCmd = ""
+	runChain(cfg, watcher, nil, quit)
 }
 
 func appDaemonTimer(t *testing.T) {
-	*daemonCmd = "sleep 1s && echo testdaemontimerOut1 && sleep 2s && echo testdaemontimerOut2"
-	*daemonTimer = 2 * int(time.Second)
+	cfg := testConfig()
+	cfg.DaemonCmd = "sleep 1s && echo testdaemontimerOut1 && sleep 2s && echo testdaemontimerOut2"
+	cfg.DaemonTimer = 2 * int(time.Second)
 
 	watcher := NewFakeWatcher()
 
@@ -131,7 +153,542 @@ func appDaemonTimer(t *testing.T) {
 		close(quit)
 	}()
 
-	runChain(watcher, quit)
-	*daemonCmd = ""
-	*daemonTimer = 0
+	runChain(cfg, watcher, nil, quit)
+}
+
+func appGraph(t *testing.T) {
+	out, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	echo := func(name string) string { return "echo " + name + " >> " + out.Name() }
+
+	cfg := testConfig()
+	cfg.Steps = []*Step{
+		{Name: "web", Kind: KindRunWait, Command: "sleep 0.3 && " + echo("web")},
+		{Name: "api", Kind: KindRunWait, Command: "sleep 0.3 && " + echo("api")},
+		{Name: "fail", Kind: KindRunWait, Command: "false"},
+		{Name: "skipped", Kind: KindRunWait, Command: echo("skipped"), DependsOn: []string{"fail"}},
+		{Name: "server", Kind: KindDaemonTimer, Command: echo("server") + " && sleep 5",
+			DependsOn: []string{"web", "api"}},
+	}
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(1 * time.Second))
+		watcher.SendCreate()
+		time.Sleep(time.Duration(1 * time.Second))
+		close(quit)
+	}()
+
+	runChain(cfg, watcher, nil, quit)
+
+	// web and api run concurrently, server after both of them and skipped never.
+	data, err := ioutil.ReadFile(out.Name())
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 6) {
+		for _, run := range [][]string{lines[:3], lines[3:]} {
+			assert.ElementsMatch(t, []string{"web", "api"}, run[:2])
+			assert.Equal(t, "server", run[2])
+		}
+	}
+}
+
+func appScope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := dir + "/out"
+
+	cfg := testConfig()
+	cfg.TargetDir = dir
+	cfg.Steps = []*Step{
+		{Name: "server", Kind: KindDaemonTimer, Command: "echo server >> " + out + " && sleep 10",
+			Watch: []string{"*.go"}},
+		{Name: "css", Kind: KindRunWait, Command: "echo css >> " + out, Watch: []string{"*.css"},
+			DependsOn: []string{"server"}},
+	}
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		// Only css is restarted, server keeps running. Then server is restarted
+		// along with css downstream of it.
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		watcher.Event <- fsnotify.Event{Name: dir + "/main.css", Op: fsnotify.Create}
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		watcher.Event <- fsnotify.Event{Name: dir + "/main.go", Op: fsnotify.Create}
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		close(quit)
+	}()
+
+	runChain(cfg, watcher, nil, quit)
+
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "server\ncss\ncss\nserver\ncss\n", string(data))
+}
+
+func appProjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig()
+	cfg.Projects = []*Project{
+		{Name: "api", Dir: dir + "/api", Steps: []*Step{
+			{Name: "server", Kind: KindDaemonTimer, Command: `echo "$WAGO_RUN_ID" >> ` + dir + "/api.out && sleep 10"},
+		}},
+		{Name: "web", Dir: dir + "/web", Steps: []*Step{
+			{Name: "build", Kind: KindRunWait, Command: `echo "$WAGO_RUN_ID" >> ` + dir + "/web.out"},
+		}},
+	}
+
+	projects, err := cfg.projects()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		// Only web is restarted, then only api.
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		watcher.Event <- fsnotify.Event{Name: dir + "/web/main.css", Op: fsnotify.Create}
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		watcher.Event <- fsnotify.Event{Name: dir + "/api/main.go", Op: fsnotify.Create}
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		close(quit)
+	}()
+
+	runProjects(projects, watcher, nil, quit)
+
+	for _, name := range []string{"api", "web"} {
+		data, err := ioutil.ReadFile(dir + "/" + name + ".out")
+		assert.NoError(t, err)
+		assert.Equal(t, "1\n2\n", string(data), name)
+	}
+}
+
+func appDebounce(t *testing.T) {
+	out, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	cfg := testConfig()
+	cfg.BuildCmd = `echo "$WAGO_RUN_ID" >> ` + out.Name()
+	cfg.Debounce = 200 * time.Millisecond
+	cfg.DebounceMax = time.Second
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		// A burst restarts once.
+		for i := 0; i < 10; i++ {
+			watcher.SendCreate()
+			time.Sleep(time.Duration(10 * time.Millisecond))
+		}
+		time.Sleep(time.Duration(500 * time.Millisecond))
+
+		// A continuous stream of 1.5s restarts after debouncemax and once more
+		// when it stops.
+		for i := 0; i < 15; i++ {
+			watcher.SendCreate()
+			time.Sleep(time.Duration(100 * time.Millisecond))
+		}
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		close(quit)
+	}()
+
+	runChain(cfg, watcher, nil, quit)
+
+	data, err := ioutil.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n2\n3\n4\n", string(data))
+}
+
+func appEnv(t *testing.T) {
+	out, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	cfg := testConfig()
+	cfg.BuildCmd = `echo "$WAGO_RUN_ID $WAGO_STEP $WAGO_EVENT_OPS $WAGO_CHANGED_FILES" >> ` + out.Name()
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		watcher.Event <- fsnotify.Event{Name: "/tmp/fake.go", Op: fsnotify.Create}
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		close(quit)
+	}()
+
+	runChain(cfg, watcher, nil, quit)
+
+	data, err := ioutil.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "1 cmd  \n2 cmd create /tmp/fake.go\n", string(data))
+}
+
+// Events that arrive while steps are stopped are part of the next run.
+func appEnvBurst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := dir + "/out"
+
+	cfg := testConfig()
+	cfg.ExitWait = 2000
+	cfg.Steps = []*Step{
+		{Name: "server", Kind: KindDaemonTimer, Timer: 10,
+			Command: `printf '%s|' "$WAGO_RUN_ID" $WAGO_CHANGED_FILES >> ` + out + ` && echo >> ` + out +
+				` && trap 'sleep 0.3; exit 0' TERM && sleep 10 & wait`},
+	}
+
+	// Buffered like the events of a project, so events can arrive while stopping.
+	watcher := &Watcher{make(chan fsnotify.Event, 8), make(chan error)}
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(300 * time.Millisecond))
+		watcher.Event <- fsnotify.Event{Name: "/tmp/a.go", Op: fsnotify.Create}
+		time.Sleep(time.Duration(100 * time.Millisecond))
+		watcher.Event <- fsnotify.Event{Name: "/tmp/b.go", Op: fsnotify.Create}
+		watcher.Event <- fsnotify.Event{Name: "/tmp/c.go", Op: fsnotify.Create}
+		time.Sleep(time.Duration(800 * time.Millisecond))
+		close(quit)
+	}()
+
+	runChain(cfg, watcher, nil, quit)
+
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "1|\n2|/tmp/a.go|/tmp/b.go|/tmp/c.go|\n", string(data))
+}
+
+func appRestart(t *testing.T) {
+	out, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	cfg := testConfig()
+	cfg.Steps = []*Step{
+		{Name: "server", Kind: KindDaemonTimer, Command: "echo crash >> " + out.Name() + " && exit 1",
+			Restart: RestartOnFailure, MaxRestarts: 2, Backoff: 10 * time.Millisecond},
+		{Name: "test", Kind: KindRunWait, Command: "echo testrestart"},
+	}
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		close(quit)
+	}()
+
+	runChain(cfg, watcher, nil, quit)
+
+	// Started once and restarted twice, then given up on.
+	data, err := ioutil.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "crash\ncrash\ncrash\n", string(data))
+}
+
+func appReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ready := dir + "/ready"
+	out := dir + "/out"
+
+	serverTimeout, neverTimeout := time.Second, 200*time.Millisecond
+
+	cfg := testConfig()
+	cfg.Steps = []*Step{
+		{Name: "server", Kind: KindDaemonReady, Command: "sleep 0.2 && touch " + ready + " && sleep 10",
+			Ready: "file://" + ready, ReadyTimeout: &serverTimeout},
+		{Name: "test", Kind: KindRunWait, Command: "echo ready >> " + out},
+		{Name: "never", Kind: KindDaemonReady, Command: "sleep 10",
+			Ready: "file://" + dir + "/never", ReadyTimeout: &neverTimeout},
+		{Name: "after", Kind: KindRunWait, Command: "echo after >> " + out},
+	}
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(1 * time.Second))
+		close(quit)
+	}()
+
+	runChain(cfg, watcher, nil, quit)
+
+	// The chain continues once the server is ready and stops when never is not.
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "ready\n", string(data))
+}
+
+// A ready timeout of 0 waits for the probe forever.
+func appReadyNoTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ready := dir + "/ready"
+	out := dir + "/out"
+
+	cfg := testConfig()
+	cfg.ReadyTimeout = 0
+	cfg.Steps = []*Step{
+		{Name: "server", Kind: KindDaemonReady, Command: "sleep 0.2 && touch " + ready + " && sleep 10",
+			Ready: "file://" + ready},
+		{Name: "test", Kind: KindRunWait, Command: "echo ready >> " + out},
+	}
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(1 * time.Second))
+		close(quit)
+	}()
+
+	runChain(cfg, watcher, nil, quit)
+
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "ready\n", string(data))
+}
+
+func appFailTrigger(t *testing.T) {
+	out, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	cfg := testConfig()
+	cfg.DaemonCmd = "echo 'listen tcp :8080: bind: address already in use' && sleep 10"
+	cfg.DaemonTrigger = `^Listening on :\d+$`
+	cfg.FailTrigger = `FATAL|address already in use`
+	cfg.PostCmd = "echo pcmd >> " + out.Name()
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		close(quit)
+	}()
+
+	// The daemon is killed right away and pcmd is not run.
+	start := time.Now()
+	runChain(cfg, watcher, nil, quit)
+	assert.True(t, time.Since(start) < time.Second)
+
+	data, err := ioutil.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(data))
+}
+
+func appTimeout(t *testing.T) {
+	out, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	cfg := testConfig()
+	cfg.Steps = []*Step{
+		{Name: "build", Command: "sleep 10", Timeout: 200 * time.Millisecond},
+		{Name: "server", Kind: KindDaemonTrigger, Command: "echo booting && sleep 10",
+			Trigger: "Listening", StartTimeout: 200 * time.Millisecond},
+		{Name: "test", Command: "echo test >> " + out.Name(), DependsOn: []string{"build"}},
+		{Name: "smoke", Command: "echo smoke >> " + out.Name(), DependsOn: []string{"server"}},
+	}
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(1 * time.Second))
+		close(quit)
+	}()
+
+	// Both are killed after their timeout and the steps after them are not run.
+	start := time.Now()
+	runChain(cfg, watcher, nil, quit)
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	data, err := ioutil.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(data))
+}
+
+func appStop(t *testing.T) {
+	out, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	cfg := testConfig()
+	cfg.Steps = []*Step{
+		{Name: "node", Kind: KindDaemonTrigger, StopSignal: "INT", Trigger: "ready",
+			Command: "trap 'echo int >> " + out.Name() + "; exit 0' INT; echo ready; while true; do sleep 0.05; done"},
+		{Name: "compose", Kind: KindDaemonTrigger, StopCommand: "echo stop $WAGO_STEP >> " + out.Name(),
+			StopGrace: 100 * time.Millisecond, Trigger: "ready", Command: "echo ready; sleep 10"},
+	}
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		close(quit)
+	}()
+
+	// The first daemon exits on SIGINT, the second is killed after its stop
+	// command and grace period.
+	start := time.Now()
+	runChain(cfg, watcher, nil, quit)
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	data, err := ioutil.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "int\n")
+	assert.Contains(t, string(data), "stop compose\n")
+}
+
+func appPTY(t *testing.T) {
+	out, err := ioutil.TempFile("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	cfg := testConfig()
+	cfg.Steps = []*Step{
+		{Name: "server", Kind: KindDaemonTrigger, PTY: true, Trigger: "^Listening$",
+			Command: "printf '\\033[32mListening\\033[0m\\n'; sleep 10"},
+		{Name: "test", PTY: true, Command: "test -t 0 && test -t 1 && test -t 2 && echo tty >> " + out.Name()},
+		{Name: "pipe", Command: "test -t 1 || echo pipe >> " + out.Name()},
+	}
+
+	watcher := NewFakeWatcher()
+
+	quit := make(chan struct{})
+	go func() {
+		time.Sleep(time.Duration(500 * time.Millisecond))
+		close(quit)
+	}()
+
+	runChain(cfg, watcher, nil, quit)
+
+	// The trigger matches the colored output of the server.
+	data, err := ioutil.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "tty\npipe\n", string(data))
+}
+
+func appControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := dir + "/out"
+
+	cfg := testConfig()
+	cfg.Steps = []*Step{
+		{Name: "server", Kind: KindDaemonTimer, Command: "echo server >> " + out + " && sleep 10", Timer: 10},
+		{Name: "test", Kind: KindRunWait, Command: "echo test >> " + out},
+	}
+
+	watcher := NewFakeWatcher()
+	ctls := make(chan control)
+	quit := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		runChain(cfg, watcher, ctls, quit)
+		close(finished)
+	}()
+
+	read := func() string {
+		time.Sleep(300 * time.Millisecond)
+		data, _ := ioutil.ReadFile(out)
+		return string(data)
+	}
+	assert.Equal(t, "server\ntest\n", read())
+
+	// Restarting a step leaves the steps upstream of it running.
+	found := make(chan bool, 1)
+	ctls <- control{action: controlRestart, step: "test", found: found}
+	assert.True(t, <-found)
+	assert.Equal(t, "server\ntest\ntest\n", read())
+
+	ctls <- control{action: controlKill, step: "nope", found: found}
+	assert.False(t, <-found)
+	ctls <- control{action: controlKill, step: "server", found: found}
+	assert.True(t, <-found)
+	ctls <- control{action: controlStatus}
+	// A control without found gets no answer.
+	ctls <- control{action: controlRestart, step: "nope"}
+
+	// Events are recorded while paused and result in a single restart on resume.
+	ctls <- control{action: controlPause}
+	watcher.SendCreate()
+	watcher.SendCreate()
+	assert.Equal(t, "server\ntest\ntest\n", read())
+
+	ctls <- control{action: controlResume}
+	assert.Equal(t, "server\ntest\ntest\nserver\ntest\n", read())
+	ctls <- control{action: controlPause}
+	ctls <- control{action: controlResume}
+	assert.Equal(t, "server\ntest\ntest\nserver\ntest\n", read())
+
+	ctls <- control{action: controlRestart}
+	assert.Equal(t, "server\ntest\ntest\nserver\ntest\nserver\ntest\n", read())
+
+	close(quit)
+	<-finished
 }
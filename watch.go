@@ -0,0 +1,301 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchRoot is the user specified path of a project to watch.
+type watchRoot struct {
+	cfg    *Config
+	log    prefixLog
+	ignore *regexp.Regexp
+	ig     *ignorer
+}
+
+// dirWatcher adds directories to a fsnotify watcher and keeps the watched
+// directories up to date as directories are created, removed and renamed.
+type dirWatcher struct {
+	*fsnotify.Watcher
+	roots []*watchRoot
+
+	// dirs is the set of watched directories. After setup it is only used by the
+	// goroutine forwarding events.
+	dirs map[string]struct{}
+
+	// limit is set if a dir could not be watched due to system limits.
+	limit error
+}
+
+// defaultPoll is the polling interval used when Wago falls back to polling.
+const defaultPoll = time.Second
+
+// newWatchRoots constructs the watchRoot of each project.
+func newWatchRoots(projects []*Config) []*watchRoot {
+	roots := make([]*watchRoot, len(projects))
+
+	for i, cfg := range projects {
+		root := &watchRoot{cfg: cfg, log: prefixLog(cfg.Name), ig: cfg.ignorer()}
+
+		var err error
+		root.ignore, err = regexp.Compile(cfg.IgnoreRegex)
+		if err != nil {
+			root.log.Fatal("Ignore regex compile error:", err)(1)
+		}
+
+		if _, err := os.Stat(cfg.TargetDir); err != nil {
+			root.log.Fatal("Directory does not exist (path, error):", cfg.TargetDir, err)(1)
+		}
+
+		roots[i] = root
+	}
+
+	return roots
+}
+
+// watchLimit reports whether err is due to the system limit of inotify instances
+// or watches.
+func watchLimit(err error) bool {
+	return err == syscall.EMFILE || err == syscall.ENOSPC
+}
+
+// newWatcher configures a watcher for the user specified path of each project.
+// The returned struct contains the two channels corresponding to those from the
+// fsnotify package.
+//
+// Events come from fsnotify unless -poll is set or the system limits of fsnotify
+// are exhausted, then the file system is polled.
+func newWatcher(projects []*Config) *Watcher {
+	roots := newWatchRoots(projects)
+
+	if poll := projects[0].Poll; poll > 0 {
+		return newPollWatcher(roots, poll, projects[0].PollHash)
+	}
+
+	// Create the local watcher from fsnotify. See wago_test.go where an artificial
+	// watcher is used instead.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		if watchLimit(err) {
+			log.Warn("Can't watch, falling back to polling (error, interval):", err, defaultPoll)
+			return newPollWatcher(roots, defaultPoll, projects[0].PollHash)
+		}
+		panic(err)
+	}
+
+	w := &dirWatcher{
+		Watcher: watcher,
+		roots:   roots,
+		dirs:    make(map[string]struct{}),
+	}
+
+	for _, root := range roots {
+		if root.cfg.deps != nil {
+			w.addGoDeps(root)
+		} else if root.cfg.Recursive {
+			w.addTree(root, root.cfg.TargetDir)
+		} else {
+			err = w.Add(root.cfg.TargetDir)
+			if watchLimit(err) {
+				w.limit = err
+			} else if err != nil {
+				root.log.Fatal("Error watching dir (path, error):", root.cfg.TargetDir, err)(1)
+			}
+		}
+	}
+
+	if w.limit != nil {
+		w.Close()
+		log.Warn("Can't watch all dirs, falling back to polling (error, interval):", w.limit, defaultPoll)
+		log.Warn("To use fsnotify, raise the limit (fs.inotify.max_user_watches on Linux) or ignore more dirs")
+		return newPollWatcher(roots, defaultPoll, projects[0].PollHash)
+	}
+
+	// To facilitate testing (which sends artifical events from a timer),
+	// we have an abstracted struct Watcher that holds the applicable channels.
+	// Channels cannot be converted, an extra channel is required.
+	event := make(chan fsnotify.Event)
+	go func() {
+		for {
+			ev := <-w.Events
+			created := w.update(ev)
+			event <- ev
+			for _, ev := range created {
+				event <- ev
+			}
+		}
+	}()
+
+	return &Watcher{event, w.Errors}
+}
+
+// addTree watches dir and all of its subdirectories, except those matching the
+// ignore regex or ignore files of root. It returns the paths found below dir.
+func (w *dirWatcher) addTree(root *watchRoot, dir string) []string {
+	var found []string
+
+	// checkForWatch determines if a folder should be watched or not.
+	checkForWatch := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			root.log.Err("Error reading dir, skipping:", path, err)
+			return filepath.SkipDir
+		}
+
+		if !info.IsDir() {
+			found = append(found, path)
+			return nil
+		}
+
+		if root.ignore.MatchString(path) || root.ig.ignored(path, true) {
+			root.log.Debug("Ignoring dir:", path)
+			return filepath.SkipDir
+		}
+
+		if _, ok := w.dirs[path]; ok {
+			return nil
+		}
+
+		root.log.Debug("Watching dir:", path)
+		err = w.Add(path)
+		if watchLimit(err) {
+			// Stop walking, no further dirs can be watched.
+			w.limit = err
+			root.log.Err("Error watching dir, system limit reached (path, error):", path, err)
+			return err
+		} else if err != nil {
+			root.log.Err("Error watching dir (path, error):", path, err)
+		} else {
+			w.dirs[path] = struct{}{}
+		}
+
+		return nil
+	}
+
+	// errors are handled in checkForWatch
+	filepath.Walk(dir, checkForWatch)
+	return found
+}
+
+// addGoDeps watches the dirs of the Go dependencies of root.
+func (w *dirWatcher) addGoDeps(root *watchRoot) {
+	for _, dir := range root.cfg.deps.dirList() {
+		if _, ok := w.dirs[dir]; ok {
+			continue
+		}
+
+		root.log.Debug("Watching dir of Go dependencies:", dir)
+		err := w.Add(dir)
+		if watchLimit(err) {
+			w.limit = err
+			root.log.Err("Error watching dir, system limit reached (path, error):", dir, err)
+			return
+		} else if err != nil {
+			root.log.Err("Error watching dir (path, error):", dir, err)
+		} else {
+			w.dirs[dir] = struct{}{}
+		}
+	}
+}
+
+// wanted reports whether any root needs dir to be watched.
+func (w *dirWatcher) wanted(dir string) bool {
+	for _, root := range w.roots {
+		switch {
+		case root.cfg.deps != nil:
+			if root.cfg.deps.watches(dir) {
+				return true
+			}
+		case root.cfg.Recursive:
+			if inDir(root.cfg.TargetDir, dir) {
+				return true
+			}
+		case filepath.Clean(root.cfg.TargetDir) == dir:
+			return true
+		}
+	}
+	return false
+}
+
+// updateGoDeps reloads the Go dependencies of roots affected by ev and updates
+// the watched dirs to match.
+func (w *dirWatcher) updateGoDeps(ev fsnotify.Event) {
+	reloaded := false
+	for _, root := range w.roots {
+		if root.cfg.deps != nil && root.cfg.deps.update(ev) {
+			reloaded = true
+			w.addGoDeps(root)
+		}
+	}
+
+	if !reloaded {
+		return
+	}
+
+	for dir := range w.dirs {
+		if !w.wanted(dir) {
+			log.Debug("Not watching dir, no longer needed:", dir)
+			delete(w.dirs, dir)
+			w.Remove(dir)
+		}
+	}
+}
+
+// update watches directories created within a recursively watched project and
+// stops watching directories that have been removed or renamed, along with their
+// subdirectories. The dirs of Go dependencies are updated when they change.
+//
+// Files written into a created dir before it is watched have no events of their
+// own, like with mkdir -p a/b && touch a/b/x.go, so update returns Create events
+// for the files found in it.
+func (w *dirWatcher) update(ev fsnotify.Event) []fsnotify.Event {
+	for _, root := range w.roots {
+		root.ig.update(ev)
+	}
+
+	w.updateGoDeps(ev)
+
+	var created []fsnotify.Event
+	if ev.Op&fsnotify.Create == fsnotify.Create {
+		info, err := os.Lstat(ev.Name)
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+
+		seen := make(map[string]bool)
+		for _, root := range w.roots {
+			if root.cfg.deps == nil && root.cfg.Recursive && inDir(root.cfg.TargetDir, ev.Name) {
+				for _, path := range w.addTree(root, ev.Name) {
+					if !seen[path] {
+						seen[path] = true
+						created = append(created, fsnotify.Event{Name: path, Op: fsnotify.Create})
+					}
+				}
+			}
+		}
+	}
+
+	// Events of watches that have already been removed have no name.
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && ev.Name != "" {
+		prefix := ev.Name + string(filepath.Separator)
+
+		for dir := range w.dirs {
+			if dir != ev.Name && !strings.HasPrefix(dir, prefix) {
+				continue
+			}
+
+			log.Debug("Not watching removed dir:", dir)
+			delete(w.dirs, dir)
+
+			// The watch of a removed dir is already gone, so errors are expected.
+			w.Remove(dir)
+		}
+	}
+
+	return created
+}
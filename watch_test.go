@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// expectEvent waits for an event for name, failing after a second.
+func expectEvent(t *testing.T, watcher *Watcher, name string) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-watcher.Event:
+			if ev.Name == name {
+				return
+			}
+		case err := <-watcher.Error:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("No event for", name)
+		}
+	}
+}
+
+func TestWatcherNewDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig()
+	cfg.TargetDir = dir
+	watcher := newWatcher([]*Config{cfg})
+
+	// A new dir and a dir created inside it are both watched.
+	sub := filepath.Join(dir, "sub")
+	assert.NoError(t, os.Mkdir(sub, 0755))
+	expectEvent(t, watcher, sub)
+
+	subsub := filepath.Join(sub, "subsub")
+	assert.NoError(t, os.Mkdir(subsub, 0755))
+	expectEvent(t, watcher, subsub)
+
+	file := filepath.Join(subsub, "a.txt")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("a"), 0644))
+	expectEvent(t, watcher, file)
+
+	// Ignored dirs are not.
+	git := filepath.Join(dir, ".git")
+	assert.NoError(t, os.Mkdir(git, 0755))
+	expectEvent(t, watcher, git)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(git, "HEAD"), []byte("a"), 0644))
+
+	// A renamed dir is watched by its new name.
+	renamed := filepath.Join(dir, "renamed")
+	assert.NoError(t, os.Rename(sub, renamed))
+	expectEvent(t, watcher, renamed)
+
+	file = filepath.Join(renamed, "subsub", "b.txt")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("b"), 0644))
+	expectEvent(t, watcher, file)
+}
+
+// Files already in a new dir when it is watched get Create events.
+func TestWatcherNewDirFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig()
+	cfg.TargetDir = filepath.Join(dir, "project")
+	assert.NoError(t, os.Mkdir(cfg.TargetDir, 0755))
+	watcher := newWatcher([]*Config{cfg})
+
+	// Moving a tree in, like a checkout, creates it at once.
+	pkg := filepath.Join(dir, "pkg")
+	assert.NoError(t, os.MkdirAll(filepath.Join(pkg, "sub"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(pkg, "x.go"), []byte("x"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(pkg, "sub", "y.go"), []byte("y"), 0644))
+
+	moved := filepath.Join(cfg.TargetDir, "pkg")
+	assert.NoError(t, os.Rename(pkg, moved))
+	expectEvent(t, watcher, moved)
+	expectEvent(t, watcher, filepath.Join(moved, "sub", "y.go"))
+	expectEvent(t, watcher, filepath.Join(moved, "x.go"))
+}